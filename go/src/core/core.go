@@ -1,10 +1,13 @@
 package core
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,11 +23,65 @@ func throw(a []MalType) (MalType, error) {
 	return nil, MalError{a[0]}
 }
 
+// (ex-info msg data) or (ex-info msg data cause)
+func ex_info(a []MalType) (MalType, error) {
+	if len(a) < 2 || len(a) > 3 {
+		return nil, ArityError("ex-info requires 2 or 3 args")
+	}
+	msg, ok := a[0].(string)
+	if !ok || Keyword_Q(msg) {
+		return nil, TypeError("ex-info message must be a string")
+	}
+	if a[1] != nil && !HashMap_Q(a[1]) {
+		return nil, TypeError("ex-info data must be a hash-map")
+	}
+	ex := ExInfo{msg, a[1], nil, nil}
+	if len(a) == 3 {
+		ex.Cause = a[2]
+	}
+	return ex, nil
+}
+
+func ex_data(a []MalType) (MalType, error) {
+	if ex, ok := a[0].(ExInfo); ok {
+		return ex.Data, nil
+	}
+	return nil, nil
+}
+
+// Errors raised by the interpreter are caught as their message, so
+// that is their ex-message too
+func ex_message(a []MalType) (MalType, error) {
+	switch ex := a[0].(type) {
+	case ExInfo:
+		return ex.Message, nil
+	case string:
+		if !Keyword_Q(ex) {
+			return ex, nil
+		}
+	}
+	return nil, nil
+}
+
+func ex_cause(a []MalType) (MalType, error) {
+	if ex, ok := a[0].(ExInfo); ok {
+		return ex.Cause, nil
+	}
+	return nil, nil
+}
+
+func ex_stack(a []MalType) (MalType, error) {
+	if ex, ok := a[0].(ExInfo); ok {
+		return ex.Stack, nil
+	}
+	return nil, nil
+}
+
 func fn_q(a []MalType) (MalType, error) {
 	switch f := a[0].(type) {
 	case MalFunc:
 		return !f.GetMacro(), nil
-	case Func:
+	case Func, *MultiFn:
 		return true, nil
 	case func([]MalType) (MalType, error):
 		return true, nil
@@ -43,14 +100,31 @@ func str(a []MalType) (MalType, error) {
 	return printer.Pr_list(a, false, "", "", ""), nil
 }
 
-func prn(a []MalType) (MalType, error) {
-	fmt.Println(printer.Pr_list(a, true, "", "", " "))
-	return nil, nil
+// prn and println, writing to the writer out returns for the context
+// of the evaluation calling them
+func Output(out func(context.Context) (io.Writer, error)) map[string]MalType {
+	print := func(ctx context.Context, a []MalType, readably bool) (MalType, error) {
+		w, e := out(ctx)
+		if e != nil {
+			return nil, e
+		}
+		if _, e := fmt.Fprintln(w, printer.Pr_list(a, readably, "", "", " ")); e != nil {
+			return nil, e
+		}
+		return nil, nil
+	}
+	return map[string]MalType{
+		"prn": WithContext(func(ctx context.Context, a []MalType) (MalType, error) {
+			return print(ctx, a, true)
+		}),
+		"println": WithContext(func(ctx context.Context, a []MalType) (MalType, error) {
+			return print(ctx, a, false)
+		}),
+	}
 }
 
-func println(a []MalType) (MalType, error) {
-	fmt.Println(printer.Pr_list(a, false, "", "", " "))
-	return nil, nil
+func stdout(ctx context.Context) (io.Writer, error) {
+	return os.Stdout, nil
 }
 
 func slurp(a []MalType) (MalType, error) {
@@ -62,6 +136,26 @@ func slurp(a []MalType) (MalType, error) {
 }
 
 // Number functions
+
+// A numeric builtin, on ints if both arguments are ints and otherwise
+// on floats
+func arith(name string, ints func(int, int) MalType, floats func(float64, float64) MalType) func([]MalType) (MalType, error) {
+	return func(a []MalType) (MalType, error) {
+		if len(a) != 2 {
+			return nil, ArityError(name + " requires 2 arguments")
+		}
+		x, x_int := a[0].(int)
+		y, y_int := a[1].(int)
+		if x_int && y_int {
+			return ints(x, y), nil
+		}
+		if !Number_Q(a[0]) || !Number_Q(a[1]) {
+			return nil, TypeError(name + " called with non-number")
+		}
+		return floats(ToFloat(a[0]), ToFloat(a[1])), nil
+	}
+}
+
 func time_ms(a []MalType) (MalType, error) {
 	return int(time.Now().UnixNano() / int64(time.Millisecond)), nil
 }
@@ -77,76 +171,120 @@ func copy_hash_map(hm HashMap) HashMap {
 
 func assoc(a []MalType) (MalType, error) {
 	if len(a) < 3 {
-		return nil, errors.New("assoc requires at least 3 arguments")
+		return nil, ArityError("assoc requires at least 3 arguments")
 	}
 	if len(a)%2 != 1 {
-		return nil, errors.New("assoc requires odd number of arguments")
+		return nil, ArityError("assoc requires odd number of arguments")
 	}
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("assoc called on non-hash map")
+	entries, ok := MapEntries(a[0])
+	if !ok {
+		return nil, TypeError("assoc called on non-hash map")
 	}
-	new_hm := copy_hash_map(a[0].(HashMap))
+	new_hm := copy_hash_map(HashMap{entries, nil})
 	for i := 1; i < len(a); i += 2 {
 		key := a[i]
 		if !String_Q(key) {
-			return nil, errors.New("assoc called with non-string key")
+			return nil, TypeError("assoc called with non-string key")
 		}
 		new_hm.Val[key.(string)] = a[i+1]
 	}
+	if rec, ok := a[0].(Record); ok {
+		return Record{rec.Type, new_hm.Val, rec.Meta}, nil
+	}
 	return new_hm, nil
 }
 
 func dissoc(a []MalType) (MalType, error) {
 	if len(a) < 2 {
-		return nil, errors.New("dissoc requires at least 3 arguments")
+		return nil, ArityError("dissoc requires at least 3 arguments")
 	}
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("dissoc called on non-hash map")
+	entries, ok := MapEntries(a[0])
+	if !ok {
+		return nil, TypeError("dissoc called on non-hash map")
 	}
-	new_hm := copy_hash_map(a[0].(HashMap))
+	new_hm := copy_hash_map(HashMap{entries, nil})
+	rec, is_rec := a[0].(Record)
 	for i := 1; i < len(a); i += 1 {
 		key := a[i]
 		if !String_Q(key) {
-			return nil, errors.New("dissoc called with non-string key")
+			return nil, TypeError("dissoc called with non-string key")
 		}
 		delete(new_hm.Val, key.(string))
+		for j := 0; is_rec && j < len(rec.Type.Fields); j++ {
+			// without one of its fields a record is a plain map
+			is_rec = rec.Type.Fields[j] != key
+		}
+	}
+	if is_rec {
+		return Record{rec.Type, new_hm.Val, rec.Meta}, nil
 	}
 	return new_hm, nil
 }
 
+// The entries of a hash map or a record as [key value] vectors, a
+// record's in the order of its keys
+func map_seq(obj MalType) ([]MalType, bool) {
+	var ks []string
+	switch m := obj.(type) {
+	case Record:
+		ks = m.Keys()
+	case HashMap:
+		for k := range m.Val {
+			ks = append(ks, k)
+		}
+	default:
+		return nil, false
+	}
+	entries, _ := MapEntries(obj)
+	slc := make([]MalType, len(ks))
+	for i, k := range ks {
+		slc[i] = Vector{[]MalType{k, entries[k]}, nil}
+	}
+	return slc, true
+}
+
 func get(a []MalType) (MalType, error) {
 	if len(a) != 2 {
-		return nil, errors.New("get requires 2 arguments")
+		return nil, ArityError("get requires 2 arguments")
 	}
 	if Nil_Q(a[0]) {
 		return nil, nil
 	}
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("get called on non-hash map")
+	entries, ok := MapEntries(a[0])
+	if !ok {
+		return nil, TypeError("get called on non-hash map")
 	}
 	if !String_Q(a[1]) {
-		return nil, errors.New("get called with non-string key")
+		return nil, TypeError("get called with non-string key")
 	}
-	return a[0].(HashMap).Val[a[1].(string)], nil
+	return entries[a[1].(string)], nil
 }
 
 func contains_Q(hm MalType, key MalType) (MalType, error) {
 	if Nil_Q(hm) {
 		return false, nil
 	}
-	if !HashMap_Q(hm) {
-		return nil, errors.New("get called on non-hash map")
+	entries, ok := MapEntries(hm)
+	if !ok {
+		return nil, TypeError("get called on non-hash map")
 	}
 	if !String_Q(key) {
-		return nil, errors.New("get called with non-string key")
+		return nil, TypeError("get called with non-string key")
 	}
-	_, ok := hm.(HashMap).Val[key.(string)]
+	_, ok = entries[key.(string)]
 	return ok, nil
 }
 
 func keys(a []MalType) (MalType, error) {
+	if rec, ok := a[0].(Record); ok {
+		slc := []MalType{}
+		for _, k := range rec.Keys() {
+			slc = append(slc, k)
+		}
+		return List{slc, nil}, nil
+	}
 	if !HashMap_Q(a[0]) {
-		return nil, errors.New("keys called on non-hash map")
+		return nil, TypeError("keys called on non-hash map")
 	}
 	slc := []MalType{}
 	for k, _ := range a[0].(HashMap).Val {
@@ -155,8 +293,15 @@ func keys(a []MalType) (MalType, error) {
 	return List{slc, nil}, nil
 }
 func vals(a []MalType) (MalType, error) {
+	if rec, ok := a[0].(Record); ok {
+		slc := []MalType{}
+		for _, k := range rec.Keys() {
+			slc = append(slc, rec.Val[k])
+		}
+		return List{slc, nil}, nil
+	}
 	if !HashMap_Q(a[0]) {
-		return nil, errors.New("keys called on non-hash map")
+		return nil, TypeError("keys called on non-hash map")
 	}
 	slc := []MalType{}
 	for _, v := range a[0].(HashMap).Val {
@@ -204,7 +349,7 @@ func nth(a []MalType) (MalType, error) {
 	if idx < len(slc) {
 		return slc[idx], nil
 	} else {
-		return nil, errors.New("nth: index out of range")
+		return nil, NotFoundError("nth: index out of range")
 	}
 }
 
@@ -245,10 +390,14 @@ func empty_Q(a []MalType) (MalType, error) {
 		return len(obj.Val) == 0, nil
 	case Vector:
 		return len(obj.Val) == 0, nil
+	case HashMap:
+		return len(obj.Val) == 0, nil
+	case Record:
+		return len(obj.Val) == 0, nil
 	case nil:
 		return true, nil
 	default:
-		return nil, errors.New("empty? called on non-sequence")
+		return nil, TypeError("empty? called on non-sequence")
 	}
 }
 
@@ -260,16 +409,20 @@ func count(a []MalType) (MalType, error) {
 		return len(obj.Val), nil
 	case map[string]MalType:
 		return len(obj), nil
+	case HashMap:
+		return len(obj.Val), nil
+	case Record:
+		return len(obj.Val), nil
 	case nil:
 		return 0, nil
 	default:
-		return nil, errors.New("count called on non-sequence")
+		return nil, TypeError("count called on non-sequence")
 	}
 }
 
 func apply(a []MalType) (MalType, error) {
 	if len(a) < 2 {
-		return nil, errors.New("apply requires at least 2 args")
+		return nil, ArityError("apply requires at least 2 args")
 	}
 	f := a[0]
 	args := []MalType{}
@@ -278,35 +431,41 @@ func apply(a []MalType) (MalType, error) {
 	}
 	last, e := GetSlice(a[len(a)-1])
 	if e != nil {
-		return nil, e
+		var ok bool
+		if last, ok = map_seq(a[len(a)-1]); !ok {
+			return nil, e
+		}
 	}
 	args = append(args, last...)
-	return Apply(f, args)
+	return &Call{f, args, nil}, nil
 }
 
 func do_map(a []MalType) (MalType, error) {
 	if len(a) != 2 {
-		return nil, errors.New("map requires 2 args")
+		return nil, ArityError("map requires 2 args")
 	}
 	f := a[0]
-	results := []MalType{}
 	args, e := GetSlice(a[1])
 	if e != nil {
 		return nil, e
 	}
-	for _, arg := range args {
-		res, e := Apply(f, []MalType{arg})
-		results = append(results, res)
-		if e != nil {
-			return nil, e
+	results := make([]MalType, 0, len(args))
+	var next func(i int) (MalType, error)
+	next = func(i int) (MalType, error) {
+		if i == len(args) {
+			return List{results, nil}, nil
 		}
+		return &Call{f, []MalType{args[i]}, func(res MalType) (MalType, error) {
+			results = append(results, res)
+			return next(i + 1)
+		}}, nil
 	}
-	return List{results, nil}, nil
+	return next(0)
 }
 
 func conj(a []MalType) (MalType, error) {
 	if len(a) < 2 {
-		return nil, errors.New("conj requires at least 2 arguments")
+		return nil, ArityError("conj requires at least 2 arguments")
 	}
 	switch seq := a[0].(type) {
 	case List:
@@ -323,18 +482,29 @@ func conj(a []MalType) (MalType, error) {
 		return Vector{new_slc, nil}, nil
 	}
 
-	if !HashMap_Q(a[0]) {
-		return nil, errors.New("dissoc called on non-hash map")
+	// a hash map or record takes [key value] vectors and the entries
+	// of other maps
+	if _, ok := MapEntries(a[0]); !ok {
+		return nil, TypeError("conj called on non-collection")
 	}
-	new_hm := copy_hash_map(a[0].(HashMap))
-	for i := 1; i < len(a); i += 1 {
-		key := a[i]
-		if !String_Q(key) {
-			return nil, errors.New("dissoc called with non-string key")
+	kvs := []MalType{a[0]}
+	for _, x := range a[1:] {
+		if entries, ok := map_seq(x); ok {
+			for _, entry := range entries {
+				kvs = append(kvs, entry.(Vector).Val...)
+			}
+			continue
 		}
-		delete(new_hm.Val, key.(string))
+		if pair, e := GetSlice(x); e == nil && len(pair) == 2 {
+			kvs = append(kvs, pair...)
+			continue
+		}
+		return nil, TypeError("conj on a map requires [key value] vectors or maps")
 	}
-	return new_hm, nil
+	if len(kvs) == 1 {
+		return a[0], nil
+	}
+	return assoc(kvs)
 }
 
 func seq(a []MalType) (MalType, error) {
@@ -361,14 +531,20 @@ func seq(a []MalType) (MalType, error) {
 			new_slc = append(new_slc, ch)
 		}
 		return List{new_slc, nil}, nil
+	case HashMap, Record:
+		entries, _ := map_seq(arg)
+		if len(entries) == 0 {
+			return nil, nil
+		}
+		return List{entries, nil}, nil
 	}
-	return nil, errors.New("seq requires string or list or vector or nil")
+	return nil, TypeError("seq requires string or list or vector or map or nil")
 }
 
 // Metadata functions
 func with_meta(a []MalType) (MalType, error) {
 	if len(a) != 2 {
-		return nil, errors.New("with-meta requires 2 args")
+		return nil, ArityError("with-meta requires 2 args")
 	}
 	obj := a[0]
 	m := a[1]
@@ -379,6 +555,8 @@ func with_meta(a []MalType) (MalType, error) {
 		return Vector{tobj.Val, m}, nil
 	case HashMap:
 		return HashMap{tobj.Val, m}, nil
+	case Record:
+		return Record{tobj.Type, tobj.Val, m}, nil
 	case Func:
 		return Func{tobj.Fn, m}, nil
 	case MalFunc:
@@ -386,7 +564,7 @@ func with_meta(a []MalType) (MalType, error) {
 		fn.Meta = m
 		return fn, nil
 	default:
-		return nil, errors.New("with-meta not supported on type")
+		return nil, TypeError("with-meta not supported on type")
 	}
 }
 
@@ -399,26 +577,49 @@ func meta(a []MalType) (MalType, error) {
 		return tobj.Meta, nil
 	case HashMap:
 		return tobj.Meta, nil
+	case Record:
+		return tobj.Meta, nil
 	case Func:
 		return tobj.Meta, nil
 	case MalFunc:
 		return tobj.Meta, nil
 	default:
-		return nil, errors.New("meta not supported on type")
+		return nil, TypeError("meta not supported on type")
 	}
 }
 
 // Atom functions
-func deref(a []MalType) (MalType, error) {
-	if !Atom_Q(a[0]) {
-		return nil, errors.New("deref called with non-atom")
+func deref(ctx context.Context, a []MalType) (MalType, error) {
+	if len(a) != 1 && len(a) != 3 {
+		return nil, ArityError("deref requires 1 or 3 args")
+	}
+	switch obj := a[0].(type) {
+	case *Atom:
+		return obj.Deref(), nil
+	case *Var:
+		return obj.Get(ctx), nil
+	case *Future:
+		timeout := time.Duration(-1)
+		if len(a) == 3 {
+			ms, ok := a[1].(int)
+			if !ok {
+				return nil, TypeError("deref timeout must be a number")
+			}
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+		val, ok, e := obj.Wait(ctx, timeout)
+		if !ok && e == nil {
+			return a[2], nil
+		}
+		return val, e
+	default:
+		return nil, TypeError("deref called with non-atom")
 	}
-	return a[0].(*Atom).Val, nil
 }
 
 func reset_BANG(a []MalType) (MalType, error) {
 	if !Atom_Q(a[0]) {
-		return nil, errors.New("reset! called with non-atom")
+		return nil, TypeError("reset! called with non-atom")
 	}
 	a[0].(*Atom).Set(a[1])
 	return a[1], nil
@@ -426,21 +627,297 @@ func reset_BANG(a []MalType) (MalType, error) {
 
 func swap_BANG(a []MalType) (MalType, error) {
 	if !Atom_Q(a[0]) {
-		return nil, errors.New("swap! called with non-atom")
+		return nil, TypeError("swap! called with non-atom")
 	}
 	if len(a) < 2 {
-		return nil, errors.New("swap! requires at least 2 args")
+		return nil, ArityError("swap! requires at least 2 args")
+	}
+	return a[0].(*Atom).SwapCall(a[1], a[2:]), nil
+}
+
+func compare_and_set_BANG(a []MalType) (MalType, error) {
+	if len(a) != 3 {
+		return nil, ArityError("compare-and-set! requires 3 args")
+	}
+	if !Atom_Q(a[0]) {
+		return nil, TypeError("compare-and-set! called with non-atom")
+	}
+	return a[0].(*Atom).CompareAndSet(a[1], a[2]), nil
+}
+
+// Concurrency functions
+func future_call(ctx context.Context, start starter, a []MalType) (MalType, error) {
+	if len(a) != 1 {
+		return nil, ArityError("future-call requires 1 arg")
+	}
+	fut := NewFuture(false)
+	apply, done := start(ctx)
+	go func() {
+		defer done()
+		fut.Deliver(apply(a[0], []MalType{}))
+	}()
+	return fut, nil
+}
+
+func deliver(a []MalType) (MalType, error) {
+	if len(a) != 2 {
+		return nil, ArityError("deliver requires 2 args")
+	}
+	p, ok := a[0].(*Future)
+	if !ok || !p.IsPromise {
+		return nil, TypeError("deliver called with non-promise")
+	}
+	if !p.Deliver(a[1], nil) {
+		return nil, nil
+	}
+	return p, nil
+}
+
+func realized_Q(a []MalType) (MalType, error) {
+	switch obj := a[0].(type) {
+	case *Future:
+		return obj.Realized(), nil
+	default:
+		return nil, TypeError("realized? called with non-future")
+	}
+}
+
+func pmap(ctx context.Context, start starter, a []MalType) (MalType, error) {
+	if len(a) != 2 {
+		return nil, ArityError("pmap requires 2 args")
+	}
+	f := a[0]
+	args, e := GetSlice(a[1])
+	if e != nil {
+		return nil, e
+	}
+	results := make([]MalType, len(args))
+	errs := make([]error, len(args))
+	apply, done := start(ctx)
+	defer done()
+	var wg sync.WaitGroup
+	for i, arg := range args {
+		wg.Add(1)
+		go func(i int, arg MalType) {
+			defer wg.Done()
+			results[i], errs[i] = apply(f, []MalType{arg})
+		}(i, arg)
+	}
+	wg.Wait()
+	for _, e := range errs {
+		if e != nil {
+			return nil, e
+		}
+	}
+	return List{results, nil}, nil
+}
+
+// Run a thunk on its own goroutine. Returns a channel that receives
+// the result and is then closed; if the thunk throws, taking from the
+// channel re-raises the error.
+func go_STAR(ctx context.Context, start starter, a []MalType) (MalType, error) {
+	if len(a) != 1 {
+		return nil, ArityError("go* requires 1 arg")
+	}
+	c := NewChan(1)
+	apply, done := start(ctx)
+	go func() {
+		defer done()
+		defer c.Close()
+		res, e := apply(a[0], []MalType{})
+		if e != nil {
+			c.Fail(e)
+		} else if res != nil {
+			c.Put(context.Background(), res)
+		}
+	}()
+	return c, nil
+}
+
+// Channel functions
+func chan_arg(a []MalType, fn string) (*Chan, error) {
+	if len(a) == 0 || !Chan_Q(a[0]) {
+		return nil, TypeError(fn + " called with non-channel")
+	}
+	return a[0].(*Chan), nil
+}
+
+func do_chan(a []MalType) (MalType, error) {
+	if len(a) == 0 || a[0] == nil {
+		return NewChan(0), nil
+	}
+	size, ok := a[0].(int)
+	if !ok || size < 0 {
+		return nil, TypeError("chan buffer size must be a non-negative number")
+	}
+	return NewChan(size), nil
+}
+
+func put_BANG(ctx context.Context, a []MalType) (MalType, error) {
+	c, e := chan_arg(a, ">!")
+	if e != nil {
+		return nil, e
+	}
+	if len(a) != 2 {
+		return nil, ArityError(">! requires 2 args")
+	}
+	if a[1] == nil {
+		return nil, TypeError(">! cannot put nil on a channel")
+	}
+	return c.Put(ctx, a[1])
+}
+
+func take_BANG(ctx context.Context, a []MalType) (MalType, error) {
+	c, e := chan_arg(a, "<!")
+	if e != nil {
+		return nil, e
+	}
+	return c.Take(ctx)
+}
+
+func close_BANG(a []MalType) (MalType, error) {
+	c, e := chan_arg(a, "close!")
+	if e != nil {
+		return nil, e
+	}
+	c.Close()
+	return nil, nil
+}
+
+// (alts! [c1 [c2 val] ...]) takes from c1 or puts val on c2, whichever
+// is ready first, and returns [result port]. With a trailing
+// :default val, returns [val :default] if nothing is ready.
+func alts_BANG(ctx context.Context, a []MalType) (MalType, error) {
+	if len(a) != 1 && len(a) != 3 {
+		return nil, ArityError("alts! requires 1 or 3 args")
 	}
-	atm := a[0].(*Atom)
-	args := []MalType{atm.Val}
-	f := a[1]
-	args = append(args, a[2:]...)
-	res, e := Apply(f, args)
+	ports, e := GetSlice(a[0])
 	if e != nil {
 		return nil, e
 	}
-	atm.Set(res)
-	return res, nil
+	block := true
+	if len(a) == 3 {
+		if !Equal_Q(a[1], "\u029edefault") {
+			return nil, TypeError("alts! only supports the :default option")
+		}
+		block = false
+	}
+	ops := make([]ChanOp, 0, len(ports))
+	for _, port := range ports {
+		switch p := port.(type) {
+		case *Chan:
+			ops = append(ops, ChanOp{Chan: p})
+		case Vector:
+			if len(p.Val) != 2 || !Chan_Q(p.Val[0]) || p.Val[1] == nil {
+				return nil, TypeError("alts! put must be [channel value]")
+			}
+			ops = append(ops, ChanOp{p.Val[0].(*Chan), true, p.Val[1]})
+		default:
+			return nil, TypeError("alts! ports must be channels or [channel value]")
+		}
+	}
+	idx, val, e := Alts(ctx, ops, block)
+	if e != nil {
+		return nil, e
+	}
+	if idx < 0 {
+		kw, _ := NewKeyword("default")
+		return Vector{[]MalType{a[2], kw}, nil}, nil
+	}
+	return Vector{[]MalType{val, ops[idx].Chan}, nil}, nil
+}
+
+// Returns a channel that closes after the given number of milliseconds
+func timeout(a []MalType) (MalType, error) {
+	ms, ok := a[0].(int)
+	if !ok {
+		return nil, TypeError("timeout requires a number of milliseconds")
+	}
+	c := NewChan(0)
+	time.AfterFunc(time.Duration(ms)*time.Millisecond, c.Close)
+	return c, nil
+}
+
+// The functions that block, waiting in the context of the evaluation
+// calling them so that cancelling it stops them. They leave that to the
+// evaluator, returning an InContext, and NS has them waiting in the
+// background context.
+func Blocking() map[string]MalType {
+	return map[string]MalType{
+		"deref": WithContext(deref),
+		">!":    WithContext(put_BANG),
+		"<!":    WithContext(take_BANG),
+		"alts!": WithContext(alts_BANG),
+	}
+}
+
+// How the functions that run functions on other goroutines start work
+// for the evaluation with context ctx: apply calls the functions as
+// part of it, and done is called when the work is over
+type starter func(ctx context.Context) (apply func(MalType, []MalType) (MalType, error), done func())
+
+// The functions that run functions on other goroutines, started with
+// start so that they count against the evaluation that started them
+// and stop with it. They too return an InContext, and NS has them
+// calling Apply.
+func Concurrent(start starter) map[string]MalType {
+	in_context := func(f func(context.Context, starter, []MalType) (MalType, error)) MalType {
+		return WithContext(func(ctx context.Context, a []MalType) (MalType, error) {
+			return f(ctx, start, a)
+		})
+	}
+	return map[string]MalType{
+		"future-call": in_context(future_call),
+		"pmap":        in_context(pmap),
+		"go*":         in_context(go_STAR),
+	}
+}
+
+func start_in_background(ctx context.Context) (func(MalType, []MalType) (MalType, error), func()) {
+	return Apply, func() {}
+}
+
+// The functions that call functions they are given. They leave the
+// calls to the evaluator, returning a *Call, and NS has them making the
+// calls themselves.
+func Stackless() map[string]MalType {
+	return map[string]MalType{
+		"apply": apply,
+		"map":   do_map,
+		"swap!": swap_BANG,
+	}
+}
+
+func resolved(f func([]MalType) (MalType, error)) func([]MalType) (MalType, error) {
+	return func(a []MalType) (MalType, error) {
+		return Resolve(f(a))
+	}
+}
+
+func init() {
+	for k, v := range Stackless() {
+		NS[k] = resolved(v.(func([]MalType) (MalType, error)))
+	}
+	for k, v := range Blocking() {
+		NS[k] = resolved(v.(func([]MalType) (MalType, error)))
+	}
+	for k, v := range Concurrent(start_in_background) {
+		NS[k] = resolved(v.(func([]MalType) (MalType, error)))
+	}
+	for k, v := range Output(stdout) {
+		NS[k] = resolved(v.(func([]MalType) (MalType, error)))
+	}
+}
+
+// The capability each function that reaches outside the interpreter
+// needs. The rest are pure.
+var Capability = map[string]string{
+	"prn":      "io-write",
+	"println":  "io-write",
+	"slurp":    "io-read",
+	"readline": "io-read",
+	"time-ms":  "time",
+	"timeout":  "time",
 }
 
 // core namespace
@@ -448,7 +925,15 @@ var NS = map[string]MalType{
 	"=": func(a []MalType) (MalType, error) {
 		return Equal_Q(a[0], a[1]), nil
 	},
-	"throw": throw,
+	"throw":      throw,
+	"ex-info":    ex_info,
+	"ex-data":    ex_data,
+	"ex-message": ex_message,
+	"ex-cause":   ex_cause,
+	"ex-stack":   ex_stack,
+	"ex-info?": func(a []MalType) (MalType, error) {
+		return ExInfo_Q(a[0]), nil
+	},
 	"nil?": func(a []MalType) (MalType, error) {
 		return Nil_Q(a[0]), nil
 	},
@@ -485,42 +970,42 @@ var NS = map[string]MalType{
 		return MalFunc_Q(a[0]) && a[0].(MalFunc).GetMacro(), nil
 	},
 
-	"pr-str":  func(a []MalType) (MalType, error) { return pr_str(a) },
-	"str":     func(a []MalType) (MalType, error) { return str(a) },
-	"prn":     func(a []MalType) (MalType, error) { return prn(a) },
-	"println": func(a []MalType) (MalType, error) { return println(a) },
+	"pr-str": func(a []MalType) (MalType, error) { return pr_str(a) },
+	"str":    func(a []MalType) (MalType, error) { return str(a) },
 	"read-string": func(a []MalType) (MalType, error) {
 		return reader.Read_str(a[0].(string))
 	},
-	"slurp": slurp,
+	"slurp":          slurp,
+	"json-parse":     json_parse,
+	"json-stringify": json_stringify,
 	"readline": func(a []MalType) (MalType, error) {
 		return readline.Readline(a[0].(string))
 	},
 
-	"<": func(a []MalType) (MalType, error) {
-		return a[0].(int) < a[1].(int), nil
-	},
-	"<=": func(a []MalType) (MalType, error) {
-		return a[0].(int) <= a[1].(int), nil
-	},
-	">": func(a []MalType) (MalType, error) {
-		return a[0].(int) > a[1].(int), nil
-	},
-	">=": func(a []MalType) (MalType, error) {
-		return a[0].(int) >= a[1].(int), nil
-	},
-	"+": func(a []MalType) (MalType, error) {
-		return a[0].(int) + a[1].(int), nil
-	},
-	"-": func(a []MalType) (MalType, error) {
-		return a[0].(int) - a[1].(int), nil
-	},
-	"*": func(a []MalType) (MalType, error) {
-		return a[0].(int) * a[1].(int), nil
-	},
-	"/": func(a []MalType) (MalType, error) {
-		return a[0].(int) / a[1].(int), nil
-	},
+	"<": arith("<",
+		func(x, y int) MalType { return x < y },
+		func(x, y float64) MalType { return x < y }),
+	"<=": arith("<=",
+		func(x, y int) MalType { return x <= y },
+		func(x, y float64) MalType { return x <= y }),
+	">": arith(">",
+		func(x, y int) MalType { return x > y },
+		func(x, y float64) MalType { return x > y }),
+	">=": arith(">=",
+		func(x, y int) MalType { return x >= y },
+		func(x, y float64) MalType { return x >= y }),
+	"+": arith("+",
+		func(x, y int) MalType { return x + y },
+		func(x, y float64) MalType { return x + y }),
+	"-": arith("-",
+		func(x, y int) MalType { return x - y },
+		func(x, y float64) MalType { return x - y }),
+	"*": arith("*",
+		func(x, y int) MalType { return x * y },
+		func(x, y float64) MalType { return x * y }),
+	"/": arith("/",
+		func(x, y int) MalType { return x / y },
+		func(x, y float64) MalType { return x / y }),
 	"time-ms": time_ms,
 
 	"list": func(a []MalType) (MalType, error) {
@@ -539,7 +1024,14 @@ var NS = map[string]MalType{
 		return NewHashMap(List{a, nil})
 	},
 	"map?": func(a []MalType) (MalType, error) {
-		return HashMap_Q(a[0]), nil
+		_, ok := MapEntries(a[0])
+		return ok, nil
+	},
+	"record?": func(a []MalType) (MalType, error) {
+		return Record_Q(a[0]), nil
+	},
+	"type": func(a []MalType) (MalType, error) {
+		return Symbol{TypeName(a[0])}, nil
 	},
 	"assoc":  assoc,
 	"dissoc": dissoc,
@@ -560,20 +1052,33 @@ var NS = map[string]MalType{
 	"rest":   rest,
 	"empty?": empty_Q,
 	"count":  count,
-	"apply":  apply,
-	"map":    do_map,
 	"conj":   conj,
 	"seq":    seq,
 
 	"with-meta": with_meta,
 	"meta":      meta,
 	"atom": func(a []MalType) (MalType, error) {
-		return &Atom{a[0], nil}, nil
+		return NewAtom(a[0]), nil
 	},
 	"atom?": func(a []MalType) (MalType, error) {
 		return Atom_Q(a[0]), nil
 	},
-	"deref":  deref,
-	"reset!": reset_BANG,
-	"swap!":  swap_BANG,
+	"reset!":           reset_BANG,
+	"compare-and-set!": compare_and_set_BANG,
+
+	"future?": func(a []MalType) (MalType, error) {
+		return Future_Q(a[0]) && !a[0].(*Future).IsPromise, nil
+	},
+	"promise": func(a []MalType) (MalType, error) {
+		return NewFuture(true), nil
+	},
+	"deliver":   deliver,
+	"realized?": realized_Q,
+
+	"chan": do_chan,
+	"chan?": func(a []MalType) (MalType, error) {
+		return Chan_Q(a[0]), nil
+	},
+	"close!":  close_BANG,
+	"timeout": timeout,
 }
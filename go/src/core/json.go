@@ -0,0 +1,259 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	. "types"
+)
+
+// JSON options are passed as an optional trailing hash-map, for
+// example (json-parse s {:keywordize true :numbers :float}) or
+// (json-stringify obj {:indent 2})
+func json_opt(opts MalType, name string) MalType {
+	hm, ok := opts.(HashMap)
+	if !ok {
+		return nil
+	}
+	key, _ := NewKeyword(name)
+	return hm.Val[key.(string)]
+}
+
+func json_opts(a []MalType, fn string) (MalType, error) {
+	if len(a) < 1 || len(a) > 2 {
+		return nil, ArityError(fn + " requires 1 or 2 args")
+	}
+	if len(a) == 1 || a[1] == nil {
+		return nil, nil
+	}
+	if !HashMap_Q(a[1]) {
+		return nil, TypeError(fn + " options must be a hash-map")
+	}
+	return a[1], nil
+}
+
+// Decoding
+
+type json_decoder struct {
+	dec        *json.Decoder
+	keywordize bool
+	floats     bool
+}
+
+func (d *json_decoder) number(n json.Number) (MalType, error) {
+	if !d.floats {
+		if i, e := n.Int64(); e == nil {
+			return int(i), nil
+		}
+	}
+	f, e := n.Float64()
+	if e != nil {
+		return nil, errors.New("json-parse: invalid number " + n.String())
+	}
+	return f, nil
+}
+
+func (d *json_decoder) value(tok json.Token) (MalType, error) {
+	switch t := tok.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		return t, nil
+	case string:
+		return t, nil
+	case json.Number:
+		return d.number(t)
+	case json.Delim:
+		switch t {
+		case '[':
+			lst := []MalType{}
+			for d.dec.More() {
+				v, e := d.next()
+				if e != nil {
+					return nil, e
+				}
+				lst = append(lst, v)
+			}
+			if _, e := d.dec.Token(); e != nil {
+				return nil, e
+			}
+			return Vector{lst, nil}, nil
+		case '{':
+			m := map[string]MalType{}
+			for d.dec.More() {
+				ktok, e := d.dec.Token()
+				if e != nil {
+					return nil, e
+				}
+				k := ktok.(string)
+				if d.keywordize {
+					kw, _ := NewKeyword(k)
+					k = kw.(string)
+				}
+				v, e := d.next()
+				if e != nil {
+					return nil, e
+				}
+				m[k] = v
+			}
+			if _, e := d.dec.Token(); e != nil {
+				return nil, e
+			}
+			return HashMap{m, nil}, nil
+		}
+	}
+	return nil, errors.New("json-parse: unexpected token")
+}
+
+func (d *json_decoder) next() (MalType, error) {
+	tok, e := d.dec.Token()
+	if e != nil {
+		return nil, e
+	}
+	return d.value(tok)
+}
+
+func json_parse(a []MalType) (MalType, error) {
+	opts, e := json_opts(a, "json-parse")
+	if e != nil {
+		return nil, e
+	}
+	s, ok := a[0].(string)
+	if !ok || Keyword_Q(a[0]) {
+		return nil, TypeError("json-parse called with non-string")
+	}
+	d := json_decoder{dec: json.NewDecoder(strings.NewReader(s))}
+	d.dec.UseNumber()
+	d.keywordize = True_Q(json_opt(opts, "keywordize"))
+	switch num := json_opt(opts, "numbers"); {
+	case num == nil || Equal_Q(num, "\u029eint"):
+	case Equal_Q(num, "\u029efloat"):
+		d.floats = true
+	default:
+		return nil, TypeError("json-parse: :numbers must be :int or :float")
+	}
+	res, e := d.next()
+	if e != nil {
+		if strings.HasPrefix(e.Error(), "json-parse: ") {
+			return nil, e
+		}
+		return nil, errors.New("json-parse: " + e.Error())
+	}
+	if _, e := d.dec.Token(); e != io.EOF {
+		return nil, errors.New("json-parse: trailing data after value")
+	}
+	return res, nil
+}
+
+// Encoding
+
+func json_write_scalar(buf *bytes.Buffer, v interface{}) error {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if e := enc.Encode(v); e != nil {
+		return e
+	}
+	// Encode always terminates the value with a newline
+	buf.Truncate(buf.Len() - 1)
+	return nil
+}
+
+func json_key(k string) string {
+	if strings.HasPrefix(k, "\u029e") {
+		return k[2:]
+	}
+	return k
+}
+
+func json_write(buf *bytes.Buffer, obj MalType) error {
+	switch tobj := obj.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool, int, float64:
+		return json_write_scalar(buf, tobj)
+	case string:
+		return json_write_scalar(buf, json_key(tobj))
+	case Symbol:
+		return json_write_scalar(buf, tobj.Val)
+	case List, Vector:
+		slc, _ := GetSlice(tobj)
+		buf.WriteByte('[')
+		for i, v := range slc {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if e := json_write(buf, v); e != nil {
+				return e
+			}
+		}
+		buf.WriteByte(']')
+	case HashMap:
+		ks := make([]string, 0, len(tobj.Val))
+		for k := range tobj.Val {
+			ks = append(ks, k)
+		}
+		sort.Slice(ks, func(i, j int) bool {
+			return json_key(ks[i]) < json_key(ks[j])
+		})
+		buf.WriteByte('{')
+		for i, k := range ks {
+			if i > 0 {
+				buf.WriteByte(',')
+				// sorted, so keys that collide are next to each other
+				if json_key(ks[i-1]) == json_key(k) {
+					return TypeError("json-stringify: duplicate key " + strconv.Quote(json_key(k)))
+				}
+			}
+			if e := json_write_scalar(buf, json_key(k)); e != nil {
+				return e
+			}
+			buf.WriteByte(':')
+			if e := json_write(buf, tobj.Val[k]); e != nil {
+				return e
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return TypeError("json-stringify: unsupported type")
+	}
+	return nil
+}
+
+func json_stringify(a []MalType) (MalType, error) {
+	opts, e := json_opts(a, "json-stringify")
+	if e != nil {
+		return nil, e
+	}
+	var buf bytes.Buffer
+	if e := json_write(&buf, a[0]); e != nil {
+		return nil, e
+	}
+	indent := ""
+	switch ind := json_opt(opts, "indent").(type) {
+	case nil:
+	case int:
+		if ind < 0 {
+			return nil, TypeError("json-stringify: :indent must not be negative")
+		}
+		indent = strings.Repeat(" ", ind)
+	case string:
+		indent = ind
+	default:
+		return nil, TypeError("json-stringify: :indent must be a number or string")
+	}
+	if indent == "" {
+		return buf.String(), nil
+	}
+	var out bytes.Buffer
+	if e := json.Indent(&out, buf.Bytes(), "", indent); e != nil {
+		return nil, e
+	}
+	return out.String(), nil
+}
@@ -1,7 +1,8 @@
 package env
 
 import (
-	"errors"
+	"sort"
+	"sync"
 	//"fmt"
 )
 
@@ -9,13 +10,31 @@ import (
 	. "types"
 )
 
+// Env is safe for concurrent use: closures captured by futures and go
+// blocks may read and def! into the same environment from several
+// goroutines at once.
+//
+// Frames built by NewFrame keep their bindings in slots, in the order
+// given by names; the analyzer in package mal (analyze.go) resolves
+// local symbols to a (depth, slot) pair so they can be read without
+// hashing. names is still consulted for by-name lookups such as eval
+// and macroexpand.
 type Env struct {
+	mu    sync.RWMutex
 	data  map[string]MalType
+	names []string
+	slots []MalType
 	outer EnvType
 }
 
+// Marks a slot whose binding has not been made yet, such as a later
+// let* binding. By-name lookups skip it, as they would a missing key.
+type unbound_t struct{}
+
+var unbound MalType = unbound_t{}
+
 func NewEnv(outer EnvType, binds_mt MalType, exprs_mt MalType) (EnvType, error) {
-	env := Env{map[string]MalType{}, outer}
+	env := &Env{data: map[string]MalType{}, outer: outer}
 
 	if binds_mt != nil && exprs_mt != nil {
 		binds, e := GetSlice(binds_mt)
@@ -41,8 +60,41 @@ func NewEnv(outer EnvType, binds_mt MalType, exprs_mt MalType) (EnvType, error)
 	return env, nil
 }
 
-func (e Env) Find(key Symbol) EnvType {
-	if _, ok := e.data[key.Val]; ok {
+// Create a slot frame. vals fills the first slots; any remaining slots
+// start out unbound.
+func NewFrame(outer EnvType, names []string, vals []MalType) *Env {
+	slots := vals
+	if len(vals) < len(names) {
+		slots = make([]MalType, len(names))
+		copy(slots, vals)
+		for i := len(vals); i < len(names); i++ {
+			slots[i] = unbound
+		}
+	}
+	return &Env{names: names, slots: slots, outer: outer}
+}
+
+func (e *Env) slot_index(name string) int {
+	for i := len(e.names) - 1; i >= 0; i-- {
+		if e.names[i] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *Env) lookup(key Symbol) (MalType, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if i := e.slot_index(key.Val); i >= 0 && e.slots[i] != unbound {
+		return e.slots[i], true
+	}
+	val, ok := e.data[key.Val]
+	return val, ok
+}
+
+func (e *Env) Find(key Symbol) EnvType {
+	if _, ok := e.lookup(key); ok {
 		return e
 	} else if e.outer != nil {
 		return e.outer.Find(key)
@@ -51,15 +103,123 @@ func (e Env) Find(key Symbol) EnvType {
 	}
 }
 
-func (e Env) Set(key Symbol, value MalType) MalType {
+func (e *Env) Set(key Symbol, value MalType) MalType {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if i := e.slot_index(key.Val); i >= 0 {
+		e.slots[i] = value
+		return value
+	}
+	if e.data == nil {
+		e.data = map[string]MalType{}
+	}
 	e.data[key.Val] = value
 	return value
 }
 
-func (e Env) Get(key Symbol) (MalType, error) {
-	env := e.Find(key)
-	if env == nil {
-		return nil, errors.New("'" + key.Val + "' not found")
+func (e *Env) Get(key Symbol) (MalType, error) {
+	var env EnvType = e
+	for env != nil {
+		cur, ok := env.(*Env)
+		if !ok {
+			return env.Get(key)
+		}
+		if val, ok := cur.lookup(key); ok {
+			return val, nil
+		}
+		env = cur.outer
+	}
+	return nil, NotFoundError("'" + key.Val + "' not found")
+}
+
+func (e *Env) Keys() []Symbol {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return sorted_keys(e.names, e.slots, e.data)
+}
+
+func (e *Env) Remove(key Symbol) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if i := e.slot_index(key.Val); i >= 0 && e.slots[i] != unbound {
+		e.slots[i] = unbound
+		return true
+	}
+	if _, ok := e.data[key.Val]; ok {
+		delete(e.data, key.Val)
+		return true
+	}
+	return false
+}
+
+func (e *Env) String() string {
+	return "#<env>"
+}
+
+func sorted_keys(names []string, slots []MalType, data map[string]MalType) []Symbol {
+	strs := make([]string, 0, len(names)+len(data))
+	for i, n := range names {
+		if slots[i] != unbound {
+			strs = append(strs, n)
+		}
+	}
+	for k := range data {
+		strs = append(strs, k)
+	}
+	sort.Strings(strs)
+	syms := make([]Symbol, len(strs))
+	for i, s := range strs {
+		syms[i] = Symbol{s}
+	}
+	return syms
+}
+
+// Read a slot of the frame depth levels up. ok is false if the slot is
+// still unbound.
+func (e *Env) Slot(depth int, slot int) (val MalType, ok bool) {
+	f := e
+	for ; depth > 0; depth-- {
+		f = f.outer.(*Env)
+	}
+	f.mu.RLock()
+	val = f.slots[slot]
+	f.mu.RUnlock()
+	return val, val != unbound
+}
+
+// The environment the frame depth levels up was made in
+func (e *Env) Outer(depth int) EnvType {
+	f := e
+	for ; depth > 0; depth-- {
+		f = f.outer.(*Env)
+	}
+	return f.outer
+}
+
+func (e *Env) SetSlot(slot int, value MalType) {
+	e.mu.Lock()
+	e.slots[slot] = value
+	e.mu.Unlock()
+}
+
+// Return the environment depth levels up, where the analyzer expects
+// names it could not resolve locally to be found. It stops early at a
+// frame that has picked up a by-name binding the analyzer did not know
+// about.
+func (e *Env) Up(depth int) EnvType {
+	var env EnvType = e
+	for ; depth > 0; depth-- {
+		f, ok := env.(*Env)
+		if !ok {
+			break
+		}
+		f.mu.RLock()
+		dynamic := f.data != nil
+		f.mu.RUnlock()
+		if dynamic {
+			break
+		}
+		env = f.outer
 	}
-	return env.(Env).data[key.Val], nil
+	return env
 }
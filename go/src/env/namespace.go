@@ -0,0 +1,219 @@
+package env
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+import (
+	. "types"
+)
+
+// A Namespace is the global environment for the code in it. It holds
+// the namespace's own definitions and resolves other names through the
+// namespaces it refers (mal.core for every namespace but itself, plus
+// any :refer'd names) and, for qualified symbols like str/join, through
+// its aliases or the full names of loaded namespaces.
+type Namespace struct {
+	Name     string
+	mu       sync.RWMutex
+	data     map[string]MalType
+	aliases  map[string]*Namespace
+	refers   map[string]*Namespace
+	uses     []*Namespace
+	registry *Namespaces
+}
+
+// The set of namespaces known to one interpreter
+type Namespaces struct {
+	mu      sync.RWMutex
+	m       map[string]*Namespace
+	core    *Namespace
+	version atomic.Uint64 // counts changes to any of them
+}
+
+func NewNamespaces(core_name string) *Namespaces {
+	r := &Namespaces{m: map[string]*Namespace{}}
+	r.core = r.Intern(core_name)
+	return r
+}
+
+func (r *Namespaces) Core() *Namespace {
+	return r.core
+}
+
+func (r *Namespaces) Find(name string) *Namespace {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.m[name]
+}
+
+// Return the named namespace, creating it if needed. New namespaces
+// refer everything in the core namespace.
+func (r *Namespaces) Intern(name string) *Namespace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ns, ok := r.m[name]; ok {
+		return ns
+	}
+	ns := &Namespace{
+		Name:     name,
+		data:     map[string]MalType{},
+		aliases:  map[string]*Namespace{},
+		refers:   map[string]*Namespace{},
+		registry: r,
+	}
+	if r.core != nil {
+		ns.uses = []*Namespace{r.core}
+	}
+	r.m[name] = ns
+	r.version.Add(1)
+	return ns
+}
+
+func (ns *Namespace) String() string {
+	return "#namespace[" + ns.Name + "]"
+}
+
+// A number that changes whenever this namespace or any other of the
+// same interpreter does, so that what a symbol resolves to can be
+// cached until the next change
+func (ns *Namespace) Version() uint64 {
+	return ns.registry.version.Load()
+}
+
+func (ns *Namespace) changed() {
+	ns.registry.version.Add(1)
+}
+
+func Namespace_Q(obj MalType) bool {
+	_, ok := obj.(*Namespace)
+	return ok
+}
+
+// Split a qualified symbol such as str/join. The symbol / on its own
+// is not qualified, but mal.core// is.
+func split_qualified(name string) (string, string, bool) {
+	i := strings.Index(name, "/")
+	if i <= 0 || i == len(name)-1 {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+func (ns *Namespace) own(name string) (MalType, bool) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	val, ok := ns.data[name]
+	return val, ok
+}
+
+func (ns *Namespace) lookup(key Symbol) (MalType, bool) {
+	if val, ok := ns.own(key.Val); ok {
+		return val, true
+	}
+	if prefix, name, ok := split_qualified(key.Val); ok {
+		if target := ns.Resolve(prefix); target != nil {
+			return target.own(name)
+		}
+		return nil, false
+	}
+	ns.mu.RLock()
+	from, referred := ns.refers[key.Val]
+	uses := ns.uses
+	ns.mu.RUnlock()
+	if referred {
+		return from.own(key.Val)
+	}
+	for _, u := range uses {
+		if val, ok := u.own(key.Val); ok {
+			return val, true
+		}
+	}
+	return nil, false
+}
+
+// Find the namespace an alias or full namespace name refers to here
+func (ns *Namespace) Resolve(name string) *Namespace {
+	ns.mu.RLock()
+	target, ok := ns.aliases[name]
+	ns.mu.RUnlock()
+	if ok {
+		return target
+	}
+	return ns.registry.Find(name)
+}
+
+func (ns *Namespace) Find(key Symbol) EnvType {
+	if _, ok := ns.lookup(key); ok {
+		return ns
+	}
+	return nil
+}
+
+func (ns *Namespace) Set(key Symbol, value MalType) MalType {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.data[key.Val] = value
+	ns.changed()
+	return value
+}
+
+func (ns *Namespace) Get(key Symbol) (MalType, error) {
+	if val, ok := ns.lookup(key); ok {
+		return val, nil
+	}
+	return nil, NotFoundError("'" + key.Val + "' not found")
+}
+
+func (ns *Namespace) Keys() []Symbol {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return sorted_keys(nil, nil, ns.data)
+}
+
+func (ns *Namespace) Remove(key Symbol) bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if _, ok := ns.data[key.Val]; ok {
+		delete(ns.data, key.Val)
+		ns.changed()
+		return true
+	}
+	return false
+}
+
+func (ns *Namespace) Alias(alias string, target *Namespace) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.aliases[alias] = target
+	ns.changed()
+}
+
+// Make a name from another namespace usable here unqualified. The
+// binding is looked up in from each time, so later redefinitions there
+// are seen here.
+func (ns *Namespace) Refer(name string, from *Namespace) error {
+	if _, ok := from.own(name); !ok {
+		return NotFoundError("'" + name + "' not found in " + from.Name)
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.refers[name] = from
+	ns.changed()
+	return nil
+}
+
+// Make every name in another namespace usable here unqualified
+func (ns *Namespace) ReferAll(from *Namespace) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for _, u := range ns.uses {
+		if u == from {
+			return
+		}
+	}
+	ns.uses = append(ns.uses, from)
+	ns.changed()
+}
@@ -0,0 +1,897 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+import (
+	. "env"
+	"printer"
+	. "types"
+)
+
+// Analysis turns a read form into a tree of nodes for exec. Macros are
+// expanded, special forms are recognised once, and symbols bound by an
+// enclosing fn*, let* or catch* are resolved to a (depth, slot) pair in
+// the chain of slot frames that will exist at run time. Everything else
+// is looked up by name, as before.
+
+// Compile time view of one slot frame
+type scope struct {
+	names  []string
+	outer  *scope
+	sealed bool         // analysis done, no more slots may be added
+	target *recurTarget // set for loop* and fn* bodies
+}
+
+// What a recur in the body of a loop* or fn* jumps back to: a fresh
+// frame like the body's with new values in the slots of the loop
+// variables or parameters
+type recurTarget struct {
+	scope *scope
+	slots []int
+	body  MalType
+	once  sync.Once // compiling body, for the VM
+	code  *chunk
+	err   error
+	// and for the Closures evaluator
+	closure_once sync.Once
+	closure      proc
+}
+
+// The innermost loop* or fn* around a scope, and how many frames out
+// its frame is
+func (s *scope) recur_target() (*recurTarget, int) {
+	for depth := 0; s != nil; s = s.outer {
+		if s.target != nil {
+			return s.target, depth
+		}
+		depth++
+	}
+	return nil, 0
+}
+
+// Find the frame and slot for a symbol. If it is not bound locally,
+// depth is the number of frames between here and the environment the
+// outermost scope was analyzed in.
+func (s *scope) resolve(name string) (depth int, slot int, ok bool) {
+	for ; s != nil; s = s.outer {
+		for i := len(s.names) - 1; i >= 0; i-- {
+			if s.names[i] == name {
+				return depth, i, true
+			}
+		}
+		depth++
+	}
+	return depth, -1, false
+}
+
+// Add a binding to the innermost scope. Returns -1 if the scope is
+// already in use, in which case the binding is made by name.
+func (s *scope) declare(name string) int {
+	for i, n := range s.names {
+		if n == name {
+			return i
+		}
+	}
+	if s.sealed {
+		return -1
+	}
+	s.names = append(s.names, name)
+	return len(s.names) - 1
+}
+
+// Nodes
+
+type quoteNode struct {
+	val MalType
+}
+
+type localRef struct {
+	sym   Symbol
+	depth int
+	slot  int
+}
+
+type globalRef struct {
+	sym   Symbol
+	depth int
+}
+
+type vectorNode struct {
+	items []MalType
+}
+
+type hashMapNode struct {
+	keys  []string
+	items []MalType
+}
+
+type defNode struct {
+	sym     Symbol
+	val     MalType
+	macro   bool
+	dynamic bool // def! ^:dynamic, making a Var
+}
+
+type bindingNode struct {
+	syms  []Symbol
+	inits []MalType
+	body  MalType
+}
+
+type setNode struct {
+	sym Symbol
+	val MalType
+}
+
+type letNode struct {
+	names  []string
+	slots  []int
+	inits  []MalType
+	body   MalType
+	target *recurTarget // for a loop*, what recur in its body jumps back to
+}
+
+type fnNode struct {
+	lam *lambda
+}
+
+type multiFnNode struct {
+	ar *arities
+}
+
+type ifNode struct {
+	cond MalType
+	then MalType
+	els  MalType
+}
+
+type doNode struct {
+	body []MalType
+}
+
+type tryNode struct {
+	body    MalType
+	catches []*catchClause
+	finally MalType
+}
+
+type catchClause struct {
+	category string  // only catch errors of this category
+	pred     MalType // or errors this function is true of
+	names    []string
+	handler  MalType
+}
+
+type recurNode struct {
+	target *recurTarget
+	depth  int
+	args   []MalType
+}
+
+type macroexpandNode struct {
+	form MalType
+	how  string // the special form: macroexpand, macroexpand-1 or macroexpand-all
+}
+
+type theEnvNode struct{}
+
+type appNode struct {
+	fn    MalType
+	args  []MalType
+	form  List   // unanalyzed, for macros defined after analysis
+	scope *scope // where form was analyzed
+	tail  bool   // whether recur may appear in its expansion
+}
+
+// A fn* form. The body is analyzed the first time the function is
+// called, so that macros defined after the fn* was evaluated but before
+// it was called are expanded as they were by the tree walker.
+type lambda struct {
+	interp   *Interpreter
+	name     string // from def!, for stack traces
+	loc      string // file:line of the fn* form, if known
+	params   MalType
+	body     MalType
+	outer    *scope
+	nreq     int
+	variadic bool
+	once     sync.Once
+	names    []string
+	binds    []MalType // let* bindings destructuring the parameters
+	code     MalType
+	target   *recurTarget // the body, as recur sees it
+	err      error
+}
+
+func (interp *Interpreter) new_lambda(params MalType, body MalType, outer *scope) (*lambda, error) {
+	slc, e := GetSlice(params)
+	if e != nil {
+		return nil, TypeError("fn* parameters must be a list or vector")
+	}
+	lam := &lambda{interp: interp, params: params, body: body, outer: outer}
+	patterns := []MalType{}
+	// patterns are bound to p__i, the parameter's position
+	param_name := func(param MalType, i int) (string, error) {
+		if sym, ok := param.(Symbol); ok {
+			return sym.Val, nil
+		}
+		if !is_pattern(param) {
+			return "", TypeError("fn* parameter must be a symbol or a destructuring pattern")
+		}
+		name := fmt.Sprintf("p__%d", i)
+		patterns = append(patterns, param, Symbol{name})
+		return name, nil
+	}
+	for i := 0; i < len(slc); i++ {
+		if sym, ok := slc[i].(Symbol); ok && sym.Val == "&" {
+			if i != len(slc)-2 {
+				return nil, TypeError("fn* & must be followed by one binding form")
+			}
+			name, e := param_name(slc[i+1], i+1)
+			if e != nil {
+				return nil, e
+			}
+			lam.variadic = true
+			lam.names = append(lam.names, name)
+			break
+		}
+		name, e := param_name(slc[i], i)
+		if e != nil {
+			return nil, e
+		}
+		lam.names = append(lam.names, name)
+		lam.nreq++
+	}
+	if len(patterns) > 0 {
+		if lam.binds, e = destructure(patterns); e != nil {
+			return nil, e
+		}
+	}
+	return lam, nil
+}
+
+// Whether a call with n arguments can run this body
+func (lam *lambda) accepts(n int) bool {
+	return n == lam.nreq || (lam.variadic && n > lam.nreq)
+}
+
+// How many arguments it takes, for arity errors
+func (lam *lambda) arity() string {
+	if lam.variadic {
+		return fmt.Sprintf("at least %d", lam.nreq)
+	}
+	return fmt.Sprint(lam.nreq)
+}
+
+func arity_error(name string, got int, expected string) error {
+	if name == "" {
+		name = "fn*"
+	}
+	return ArityError(fmt.Sprintf("%s: wrong number of arguments (got %d, expected %s)",
+		name, got, expected))
+}
+
+// Analyze the body on the first call, in the context of the evaluation
+// making it, which the macros expanded run in
+func (lam *lambda) prepare(ctx context.Context, env EnvType) error {
+	lam.once.Do(func() {
+		sc := &scope{names: lam.names, outer: lam.outer}
+		sc.target = &recurTarget{scope: sc}
+		for i := range lam.names {
+			sc.target.slots = append(sc.target.slots, i)
+		}
+		body := lam.body
+		if lam.binds != nil {
+			body = List{[]MalType{Symbol{"let*"}, Vector{lam.binds, nil}, body}, nil}
+		}
+		lam.code, lam.err = lam.interp.analyze_in(ctx, body, sc, env)
+		if lam.err == nil {
+			lam.err = check_recur(lam.code, true)
+		}
+		sc.target.body = lam.code
+		lam.target = sc.target
+		lam.names = sc.names
+	})
+	return lam.err
+}
+
+// GenEnv for the MalFuncs made from a lambda: bind the arguments into a
+// new slot frame. Apply has no evaluation to give it, so evaluators call
+// bind instead.
+func (lam *lambda) gen_env(outer EnvType, params MalType, args MalType) (EnvType, error) {
+	exprs, _ := GetSlice(args)
+	return lam.bind(context.Background(), outer, exprs)
+}
+
+// The frame for a call with args, which are copied into it
+func (lam *lambda) bind(ctx context.Context, outer EnvType, args []MalType) (*Env, error) {
+	if e := lam.prepare(ctx, outer); e != nil {
+		return nil, e
+	}
+	if !lam.accepts(len(args)) {
+		return nil, arity_error(lam.name, len(args), lam.arity())
+	}
+	vals := make([]MalType, lam.nreq, len(lam.names))
+	copy(vals, args)
+	if lam.variadic {
+		more := append([]MalType{}, args[lam.nreq:]...)
+		vals = append(vals, List{more, nil})
+	}
+	return NewFrame(outer, lam.names, vals), nil
+}
+
+// A multi-arity fn*, (fn* ([x] ...) ([x y] ...) ([x y & more] ...)),
+// with a lambda for each body, fewest parameters first
+type arities struct {
+	name string
+	lams []*lambda
+}
+
+// Whether the arguments of a fn* form are bodies with their own
+// parameter lists rather than a parameter list and a body
+func is_multi_arity(forms []MalType) bool {
+	for _, form := range forms {
+		lst, ok := form.(List)
+		if !ok || len(lst.Val) == 0 || !Sequential_Q(lst.Val[0]) {
+			return false
+		}
+	}
+	return len(forms) > 0
+}
+
+func (interp *Interpreter) new_arities(clauses []MalType, outer *scope) (*arities, error) {
+	ar := &arities{}
+	var variadic *lambda
+	fixed := map[int]bool{}
+	for _, clause := range clauses {
+		lst := clause.(List).Val
+		var body MalType
+		switch len(lst) {
+		case 1:
+		case 2:
+			body = lst[1]
+		default:
+			body = List{append([]MalType{Symbol{"do"}}, lst[1:]...), nil}
+		}
+		lam, e := interp.new_lambda(lst[0], body, outer)
+		if e != nil {
+			return nil, e
+		}
+		switch {
+		case lam.variadic && variadic != nil:
+			return nil, TypeError("fn* can have only one variadic body")
+		case lam.variadic:
+			variadic = lam
+		case fixed[lam.nreq]:
+			return nil, TypeError(fmt.Sprintf("fn* has two bodies with %d parameters", lam.nreq))
+		default:
+			fixed[lam.nreq] = true
+		}
+		ar.lams = append(ar.lams, lam)
+	}
+	for n := range fixed {
+		if variadic != nil && n > variadic.nreq {
+			return nil, TypeError("fn* cannot have a fixed arity body with more parameters than the variadic one")
+		}
+	}
+	sort.SliceStable(ar.lams, func(i, j int) bool {
+		return ar.lams[i].nreq < ar.lams[j].nreq ||
+			ar.lams[i].nreq == ar.lams[j].nreq && !ar.lams[i].variadic
+	})
+	return ar, nil
+}
+
+func (ar *arities) set_name(name string) {
+	ar.name = name
+	for _, lam := range ar.lams {
+		lam.name = name
+	}
+}
+
+// The body a call with n arguments runs
+func (ar *arities) pick(n int) (*lambda, error) {
+	for _, lam := range ar.lams {
+		if lam.accepts(n) {
+			return lam, nil
+		}
+	}
+	expected := make([]string, len(ar.lams))
+	for i, lam := range ar.lams {
+		expected[i] = lam.arity()
+	}
+	last := len(expected) - 1
+	if last > 0 {
+		expected = append(expected[:last-1], expected[last-1]+" or "+expected[last])
+	}
+	return nil, arity_error(ar.name, n, strings.Join(expected, ", "))
+}
+
+// GenEnv for multi-arity MalFuncs called through Apply. The body is
+// not known until exec picks one, so the arguments are left in a frame
+// of their own for it.
+func (ar *arities) gen_env(outer EnvType, params MalType, args MalType) (EnvType, error) {
+	return NewFrame(outer, nil, []MalType{args}), nil
+}
+
+func (ar *arities) String() string {
+	bodies := make([]string, len(ar.lams))
+	for i, lam := range ar.lams {
+		bodies[i] = printer.Pr_str(List{[]MalType{lam.params, lam.body}, nil}, true)
+	}
+	return strings.Join(bodies, " ")
+}
+
+func (lam *lambda) frame_name() string {
+	name := lam.name
+	if name == "" {
+		name = "fn*"
+	}
+	if lam.loc != "" {
+		name += " (" + lam.loc + ")"
+	}
+	return name
+}
+
+func (lam *lambda) String() string {
+	return printer.Pr_str(lam.body, true)
+}
+
+// Analyze a form in a fresh scope, repeating the analysis if def!
+// forms in it added slots to the scope after earlier references to
+// the same names were resolved elsewhere.
+func (interp *Interpreter) analyze_in(ctx context.Context, ast MalType, sc *scope, env EnvType) (MalType, error) {
+	for {
+		n := len(sc.names)
+		node, e := interp.analyze(ctx, ast, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		if len(sc.names) == n {
+			sc.sealed = true
+			return node, nil
+		}
+	}
+}
+
+func (interp *Interpreter) analyze_seq(ctx context.Context, forms []MalType, sc *scope, env EnvType) ([]MalType, error) {
+	nodes := make([]MalType, len(forms))
+	for i, f := range forms {
+		n, e := interp.analyze(ctx, f, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		nodes[i] = n
+	}
+	return nodes, nil
+}
+
+func (interp *Interpreter) analyze(ctx context.Context, ast MalType, sc *scope, env EnvType) (MalType, error) {
+	switch a := ast.(type) {
+	case Symbol:
+		depth, slot, ok := sc.resolve(a.Val)
+		if ok {
+			return localRef{a, depth, slot}, nil
+		}
+		return globalRef{a, depth}, nil
+	case Vector:
+		items, e := interp.analyze_seq(ctx, a.Val, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return vectorNode{items}, nil
+	case HashMap:
+		keys := []string{}
+		items := []MalType{}
+		for k, v := range a.Val {
+			n, e := interp.analyze(ctx, v, sc, env)
+			if e != nil {
+				return nil, e
+			}
+			keys = append(keys, k)
+			items = append(items, n)
+		}
+		return hashMapNode{keys, items}, nil
+	case List:
+		if len(a.Val) == 0 {
+			return quoteNode{a}, nil
+		}
+		return interp.analyze_list(ctx, a, sc, env)
+	default:
+		return ast, nil
+	}
+}
+
+func is_local(sym MalType, sc *scope) bool {
+	s, ok := sym.(Symbol)
+	if !ok {
+		return false
+	}
+	_, _, local := sc.resolve(s.Val)
+	return local
+}
+
+func (interp *Interpreter) analyze_list(ctx context.Context, ast List, sc *scope, env EnvType) (MalType, error) {
+	if !is_local(ast.Val[0], sc) && is_macro_call(ast, env) {
+		exp, e := interp.macroexpand(ctx, ast, env)
+		if e != nil {
+			return nil, e
+		}
+		return interp.analyze(ctx, exp, sc, env)
+	}
+
+	lst := ast.Val
+	a0 := lst[0]
+	var a1 MalType = nil
+	var a2 MalType = nil
+	if len(lst) > 1 {
+		a1 = lst[1]
+	}
+	if len(lst) > 2 {
+		a2 = lst[2]
+	}
+	a0sym := "__<*fn*>__"
+	if Symbol_Q(a0) {
+		a0sym = a0.(Symbol).Val
+	}
+	switch a0sym {
+	case "def!", "defmacro!":
+		name, meta := a1, MalType(nil)
+		if is_clause(a1, "with-meta") && len(a1.(List).Val) == 3 {
+			// as read from ^meta sym
+			name, meta = a1.(List).Val[1], a1.(List).Val[2]
+		}
+		sym, ok := name.(Symbol)
+		if !ok {
+			return nil, TypeError(a0sym + " requires a symbol")
+		}
+		if sym.Val != "/" && strings.Contains(sym.Val, "/") {
+			// definitions only go into the current namespace
+			return nil, TypeError(a0sym + " cannot define the qualified symbol " + sym.Val)
+		}
+		dynamic := is_keyword(meta, "dynamic")
+		if hm, ok := meta.(HashMap); ok {
+			flag, ok := hm.Val["\u029edynamic"]
+			dynamic = ok && flag != nil && flag != false
+		}
+		if dynamic && sc != nil {
+			return nil, TypeError("only global vars can be dynamic")
+		}
+		if sc != nil {
+			sc.declare(sym.Val)
+		}
+		val, e := interp.analyze(ctx, a2, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		if fn, ok := val.(fnNode); ok && fn.lam.name == "" {
+			fn.lam.name = sym.Val
+		}
+		if fn, ok := val.(multiFnNode); ok && fn.ar.name == "" {
+			fn.ar.set_name(sym.Val)
+		}
+		return &defNode{sym, val, a0sym == "defmacro!", dynamic}, nil
+	case "binding":
+		binds, e := GetSlice(a1)
+		if e != nil || len(binds)%2 == 1 {
+			return nil, ArityError("binding requires an even number of binding forms")
+		}
+		node := &bindingNode{}
+		for i := 0; i < len(binds); i += 2 {
+			sym, ok := binds[i].(Symbol)
+			if !ok {
+				return nil, TypeError("binding requires symbols to bind")
+			}
+			init, e := interp.analyze(ctx, binds[i+1], sc, env)
+			if e != nil {
+				return nil, e
+			}
+			node.syms = append(node.syms, sym)
+			node.inits = append(node.inits, init)
+		}
+		body, e := interp.analyze_seq(ctx, lst[2:], sc, env)
+		if e != nil {
+			return nil, e
+		}
+		node.body = &doNode{body}
+		return node, nil
+	case "set!":
+		sym, ok := a1.(Symbol)
+		if !ok || len(lst) != 3 {
+			return nil, TypeError("set! requires a symbol and a value")
+		}
+		val, e := interp.analyze(ctx, a2, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return &setNode{sym, val}, nil
+	case "let*", "loop*":
+		binds, e := GetSlice(a1)
+		if e != nil || len(binds)%2 == 1 {
+			return nil, ArityError(a0sym + " requires an even number of binding forms")
+		}
+		let_sc := &scope{outer: sc}
+		if a0sym == "loop*" {
+			// recur rebinds the loop variables, so patterns are
+			// bound to p__i, the variable's position, and
+			// destructured in the body
+			vars := make([]MalType, len(binds))
+			patterns := []MalType{}
+			for i := 0; i < len(binds); i += 2 {
+				vars[i], vars[i+1] = binds[i], binds[i+1]
+				if is_pattern(binds[i]) {
+					vars[i] = Symbol{fmt.Sprintf("p__%d", i/2)}
+					patterns = append(patterns, binds[i], vars[i])
+				}
+			}
+			if len(patterns) > 0 {
+				a2 = List{[]MalType{Symbol{"let*"}, Vector{patterns, nil}, a2}, nil}
+			}
+			binds = vars
+			let_sc.target = &recurTarget{scope: let_sc, slots: make([]int, len(binds)/2)}
+		}
+		if binds, e = destructure(binds); e != nil {
+			return nil, e
+		}
+		for i := 0; i < len(binds); i += 2 {
+			sym, ok := binds[i].(Symbol)
+			if !ok {
+				return nil, TypeError("non-symbol bind value")
+			}
+			let_sc.declare(sym.Val)
+		}
+		var node *letNode
+		for {
+			n := len(let_sc.names)
+			node = &letNode{}
+			for i := 0; i < len(binds); i += 2 {
+				init, e := interp.analyze(ctx, binds[i+1], let_sc, env)
+				if e != nil {
+					return nil, e
+				}
+				node.slots = append(node.slots, let_sc.declare(binds[i].(Symbol).Val))
+				node.inits = append(node.inits, init)
+			}
+			if node.body, e = interp.analyze(ctx, a2, let_sc, env); e != nil {
+				return nil, e
+			}
+			if len(let_sc.names) == n {
+				break
+			}
+		}
+		let_sc.sealed = true
+		node.names = let_sc.names
+		if t := let_sc.target; t != nil {
+			t.slots, t.body = node.slots, node.body
+			node.target = t
+		}
+		return node, nil
+	case "recur":
+		t, depth := sc.recur_target()
+		if t == nil {
+			return nil, TypeError("recur outside loop* or fn*")
+		}
+		if len(lst)-1 != len(t.slots) {
+			return nil, ArityError(fmt.Sprintf("recur: wrong number of arguments (got %d, expected %d)",
+				len(lst)-1, len(t.slots)))
+		}
+		args, e := interp.analyze_seq(ctx, lst[1:], sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return &recurNode{t, depth, args}, nil
+	case "quote":
+		return quoteNode{a1}, nil
+	case "quasiquote":
+		return interp.analyze(ctx, quasiquote(a1), sc, env)
+	case "macroexpand", "macroexpand-1", "macroexpand-all":
+		return macroexpandNode{a1, a0sym}, nil
+	case "the-env":
+		return theEnvNode{}, nil
+	case "try*":
+		return interp.analyze_try(ctx, lst, sc, env)
+	case "do":
+		body, e := interp.analyze_seq(ctx, lst[1:], sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return &doNode{body}, nil
+	case "if":
+		var a3 MalType = nil
+		if len(lst) > 3 {
+			a3 = lst[3]
+		}
+		nodes, e := interp.analyze_seq(ctx, []MalType{a1, a2, a3}, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return &ifNode{nodes[0], nodes[1], nodes[2]}, nil
+	case "fn*":
+		loc, _ := interp.locations.Load(&lst[0])
+		if is_multi_arity(lst[1:]) {
+			ar, e := interp.new_arities(lst[1:], sc)
+			if e != nil {
+				return nil, e
+			}
+			for _, lam := range ar.lams {
+				lam.loc, _ = loc.(string)
+			}
+			return multiFnNode{ar}, nil
+		}
+		lam, e := interp.new_lambda(a1, a2, sc)
+		if e != nil {
+			return nil, e
+		}
+		lam.loc, _ = loc.(string)
+		return fnNode{lam}, nil
+	default:
+		nodes, e := interp.analyze_seq(ctx, lst, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		return &appNode{nodes[0], nodes[1:], ast, sc, false}, nil
+	}
+}
+
+// Check that every recur is in tail position, where it is the last
+// thing its loop* or fn* does. The bodies of fn* forms in node are
+// checked when they are analyzed, before the first call.
+func check_recur(node MalType, tail bool) error {
+	check_all := func(nodes []MalType) error {
+		for _, n := range nodes {
+			if e := check_recur(n, false); e != nil {
+				return e
+			}
+		}
+		return nil
+	}
+	switch n := node.(type) {
+	case *recurNode:
+		if !tail {
+			return TypeError("recur can only be used in tail position")
+		}
+		return check_all(n.args)
+	case vectorNode:
+		return check_all(n.items)
+	case hashMapNode:
+		return check_all(n.items)
+	case *defNode:
+		return check_recur(n.val, false)
+	case *bindingNode:
+		// the bindings are undone after the body
+		if e := check_all(n.inits); e != nil {
+			return e
+		}
+		return check_recur(n.body, false)
+	case *setNode:
+		return check_recur(n.val, false)
+	case *letNode:
+		if e := check_all(n.inits); e != nil {
+			return e
+		}
+		return check_recur(n.body, tail || n.target != nil)
+	case *tryNode:
+		// the handlers run after the try* is done
+		if e := check_recur(n.body, false); e != nil {
+			return e
+		}
+		for _, c := range n.catches {
+			if e := check_all([]MalType{c.pred, c.handler}); e != nil {
+				return e
+			}
+		}
+		return check_recur(n.finally, false)
+	case *doNode:
+		if len(n.body) == 0 {
+			return nil
+		}
+		last := len(n.body) - 1
+		if e := check_all(n.body[:last]); e != nil {
+			return e
+		}
+		return check_recur(n.body[last], tail)
+	case *ifNode:
+		if e := check_recur(n.cond, false); e != nil {
+			return e
+		}
+		if e := check_recur(n.then, tail); e != nil {
+			return e
+		}
+		return check_recur(n.els, tail)
+	case *appNode:
+		n.tail = tail
+		if e := check_recur(n.fn, false); e != nil {
+			return e
+		}
+		return check_all(n.args)
+	}
+	return nil
+}
+
+func is_clause(form MalType, name string) bool {
+	lst, ok := form.(List)
+	if !ok || len(lst.Val) == 0 || !Symbol_Q(lst.Val[0]) {
+		return false
+	}
+	return lst.Val[0].(Symbol).Val == name
+}
+
+// (try* body... (catch* ...)... (finally* forms...))
+func (interp *Interpreter) analyze_try(ctx context.Context, lst []MalType, sc *scope, env EnvType) (MalType, error) {
+	i := 1
+	for i < len(lst) && !is_clause(lst[i], "catch*") &&
+		!is_clause(lst[i], "finally*") {
+		i++
+	}
+	var body MalType = nil
+	if i == 2 {
+		body = lst[1]
+	} else if i > 2 {
+		body = List{append([]MalType{Symbol{"do"}}, lst[1:i]...), nil}
+	}
+	node := &tryNode{}
+	var e error
+	if node.body, e = interp.analyze(ctx, body, sc, env); e != nil {
+		return nil, e
+	}
+	for ; i < len(lst); i++ {
+		clause := lst[i].(List).Val
+		if is_clause(lst[i], "finally*") {
+			if i != len(lst)-1 {
+				return nil, TypeError("finally* must be the last clause of try*")
+			}
+			fin := List{append([]MalType{Symbol{"do"}}, clause[1:]...), nil}
+			if node.finally, e = interp.analyze(ctx, fin, sc, env); e != nil {
+				return nil, e
+			}
+			break
+		}
+		if !is_clause(lst[i], "catch*") {
+			return nil, TypeError("try* clauses must be catch* or finally*")
+		}
+		c, e := interp.analyze_catch(ctx, clause, sc, env)
+		if e != nil {
+			return nil, e
+		}
+		node.catches = append(node.catches, c)
+	}
+	return node, nil
+}
+
+// (catch* e handler) catches everything, (catch* :category e handler)
+// or (catch* pred e handler) only some errors
+func (interp *Interpreter) analyze_catch(ctx context.Context, clause []MalType, sc *scope, env EnvType) (*catchClause, error) {
+	c := &catchClause{}
+	if len(clause) == 4 {
+		var e error
+		if Keyword_Q(clause[1]) {
+			c.category = clause[1].(string)[2:]
+			if !ErrorCategories[c.category] {
+				return nil, TypeError("catch* of unknown error category :" + c.category)
+			}
+		} else if c.pred, e = interp.analyze(ctx, clause[1], sc, env); e != nil {
+			return nil, e
+		}
+		clause = append([]MalType{clause[0]}, clause[2:]...)
+	}
+	if len(clause) < 2 || !Symbol_Q(clause[1]) {
+		return nil, TypeError("catch* requires a symbol")
+	}
+	var handler MalType = nil
+	if len(clause) > 2 {
+		handler = clause[2]
+	}
+	// the handler also sees the stack the error unwound through
+	catch_sc := &scope{names: []string{clause[1].(Symbol).Val, "*stacktrace*"}, outer: sc}
+	var e error
+	if c.handler, e = interp.analyze_in(ctx, handler, catch_sc, env); e != nil {
+		return nil, e
+	}
+	c.names = catch_sc.names
+	return c, nil
+}
@@ -0,0 +1,38 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Evaluations running at once in the same interpreter each see only
+// their own bindings
+func TestConcurrentBindings(t *testing.T) {
+	for _, ev := range evaluators {
+		interp, e := New(Options{Evaluator: ev.ev})
+		if e != nil {
+			t.Fatal(e)
+		}
+		if _, e := interp.EvalString(context.Background(), "(do (def! ^:dynamic *d* 0) (def! rd (fn* [] *d*)))"); e != nil {
+			t.Fatal(e)
+		}
+		var wg sync.WaitGroup
+		for n := 1; n <= 4; n++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				src := fmt.Sprintf(`(binding [*d* %d]
+				  (loop* [i 0] (cond (not (= (rd) %d)) (rd) (= i 2000) (rd) :else (recur (+ i 1)))))`, n, n)
+				if res, e := interp.EvalString(context.Background(), src); e != nil || res != n {
+					t.Errorf("%s: binding %d, got %v, %v", ev.name, n, res, e)
+				}
+			}(n)
+		}
+		wg.Wait()
+		if res, e := interp.EvalString(context.Background(), "(rd)"); e != nil || res != 0 {
+			t.Errorf("%s: after the bindings, got %v, %v", ev.name, res, e)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+)
+
+import (
+	. "env"
+	. "types"
+)
+
+// The Closures evaluator. Each node is turned once into a Go closure
+// that evaluates it, with the special form, the slots of its locals and
+// whether it is a constant already worked out, so evaluating is calling
+// closures. A fn* keeps its body's closure in its lambda, made on the
+// first call. An application in tail position returns a tailCall, and a
+// recur a recurFrame, for the loop running the function or loop* to
+// carry on with, so neither takes Go stack.
+//
+// Calls that are not in tail position do take Go stack. So that deep
+// recursion is limited by memory, or Options.MaxDepth, and not by the
+// size of a goroutine's stack, every hop_depth nested calls the next is
+// made on a fresh goroutine while the caller's waits.
+
+type proc func(r *runner, env EnvType) (MalType, error)
+
+// A call to make in place of the function whose body returned it
+type tailCall struct {
+	fn   MalType
+	args []MalType
+}
+
+// The frame to run the body of a loop* or fn* again in
+type recurFrame struct {
+	env *Env
+}
+
+const hop_depth = 10000
+
+// One evaluation: the depth of calls it is in
+type runner struct {
+	interp    *Interpreter
+	ctx       context.Context // of the evaluation it is part of
+	ev        *evaluation
+	depth     int
+	max_depth int
+}
+
+func (interp *Interpreter) run_closures(ctx context.Context, node MalType, env EnvType) (MalType, error) {
+	r := &runner{interp: interp, ctx: ctx, ev: evaluation_of(ctx), max_depth: interp.max_depth}
+	switch n := node.(type) {
+	case *arities:
+		// a multi-arity MalFunc called through Apply
+		f := env.(*Env)
+		args, _ := f.Slot(0, 0)
+		lam, e := n.pick(len(args.(List).Val))
+		if e != nil {
+			return nil, e
+		}
+		if env, e = lam.bind(ctx, f.Up(1), args.(List).Val); e != nil {
+			return nil, e
+		}
+		return r.call(nil, nil, lam, env)
+	case *lambda:
+		return r.call(nil, nil, n, env)
+	}
+	res, e := closure_of(node, true)(r, env)
+	if tc, ok := res.(*tailCall); ok && e == nil {
+		return r.call(tc.fn, tc.args, nil, nil)
+	}
+	return res, e
+}
+
+// The closure for the body of a loop* or fn*
+func (t *recurTarget) compiled_closure() proc {
+	t.closure_once.Do(func() {
+		t.closure = closure_of(t.body, true)
+	})
+	return t.closure
+}
+
+func closures_of(nodes []MalType) []proc {
+	procs := make([]proc, len(nodes))
+	for i, n := range nodes {
+		procs[i] = closure_of(n, false)
+	}
+	return procs
+}
+
+func eval_all(r *runner, env EnvType, procs []proc) ([]MalType, error) {
+	vals := make([]MalType, len(procs))
+	for i, p := range procs {
+		val, e := p(r, env)
+		if e != nil {
+			return nil, e
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+// The value of a node that is the same every time, if it is one
+func constant(node MalType) (MalType, bool) {
+	switch n := node.(type) {
+	case quoteNode:
+		return n.val, true
+	case vectorNode:
+		items := make([]MalType, len(n.items))
+		for i, item := range n.items {
+			val, ok := constant(item)
+			if !ok {
+				return nil, false
+			}
+			items[i] = val
+		}
+		return Vector{items, nil}, true
+	case hashMapNode:
+		vals := make([]MalType, len(n.items))
+		for i, item := range n.items {
+			val, ok := constant(item)
+			if !ok {
+				return nil, false
+			}
+			vals[i] = val
+		}
+		return new_hash_map(n.keys, vals), true
+	case nil, bool, int, string:
+		return n, true
+	}
+	return nil, false
+}
+
+// The closure for a node. If tail is true, a call it ends with is left
+// to the caller.
+func closure_of(node MalType, tail bool) proc {
+	if val, ok := constant(node); ok {
+		return func(r *runner, env EnvType) (MalType, error) {
+			return val, nil
+		}
+	}
+	switch n := node.(type) {
+	case localRef:
+		return func(r *runner, env EnvType) (MalType, error) {
+			if val, ok := env.(*Env).Slot(n.depth, n.slot); ok {
+				return val, nil
+			}
+			// not bound yet (a later let* binding), so behave
+			// as though the slot were not there
+			return lookup_var(r.ctx, env, n.sym)
+		}
+	case globalRef:
+		cache := &globalCache{}
+		return func(r *runner, env EnvType) (MalType, error) {
+			return cache.get(r.ctx, &n, env)
+		}
+	case vectorNode:
+		items := closures_of(n.items)
+		return func(r *runner, env EnvType) (MalType, error) {
+			vals, e := eval_all(r, env, items)
+			if e != nil {
+				return nil, e
+			}
+			return Vector{vals, nil}, nil
+		}
+	case hashMapNode:
+		items := closures_of(n.items)
+		return func(r *runner, env EnvType) (MalType, error) {
+			vals, e := eval_all(r, env, items)
+			if e != nil {
+				return nil, e
+			}
+			return new_hash_map(n.keys, vals), nil
+		}
+	case *defNode:
+		val := closure_of(n.val, false)
+		return func(r *runner, env EnvType) (MalType, error) {
+			res, e := val(r, env)
+			if e != nil {
+				return nil, e
+			}
+			return define(n, env, res)
+		}
+	case *setNode:
+		val := closure_of(n.val, false)
+		return func(r *runner, env EnvType) (MalType, error) {
+			res, e := val(r, env)
+			if e != nil {
+				return nil, e
+			}
+			return set_var(r.ctx, n, env, res)
+		}
+	case *bindingNode:
+		inits := closures_of(n.inits)
+		body := closure_of(n.body, false)
+		return func(r *runner, env EnvType) (MalType, error) {
+			vars := make([]*Var, len(n.syms))
+			for i, sym := range n.syms {
+				v, e := dynamic_var(env, sym)
+				if e != nil {
+					return nil, e
+				}
+				vars[i] = v
+			}
+			vals, e := eval_all(r, env, inits)
+			if e != nil {
+				return nil, e
+			}
+			bound := make(map[*Var]MalType, len(vars))
+			for i, v := range vars {
+				bound[v] = vals[i]
+			}
+			outside := r.ctx
+			r.ctx = Bind(r.ctx, bound)
+			res, e := body(r, env)
+			r.ctx = outside
+			return res, e
+		}
+	case *letNode:
+		inits := closures_of(n.inits)
+		body := closure_of(n.body, tail)
+		return func(r *runner, env EnvType) (MalType, error) {
+			frame := NewFrame(env, n.names, nil)
+			for i, init := range inits {
+				val, e := init(r, frame)
+				if e != nil {
+					return nil, e
+				}
+				frame.SetSlot(n.slots[i], val)
+			}
+			if n.target == nil {
+				return body(r, frame)
+			}
+			for {
+				res, e := body(r, frame)
+				rf, ok := res.(*recurFrame)
+				if e != nil || !ok {
+					return res, e
+				}
+				if e := r.step(); e != nil {
+					return nil, e
+				}
+				frame = rf.env
+			}
+		}
+	case *recurNode:
+		args := closures_of(n.args)
+		t := n.target
+		return func(r *runner, env EnvType) (MalType, error) {
+			vals, e := eval_all(r, env, args)
+			if e != nil {
+				return nil, e
+			}
+			frame := NewFrame(env.(*Env).Outer(n.depth), t.scope.names, nil)
+			for i, val := range vals {
+				frame.SetSlot(t.slots[i], val)
+			}
+			return &recurFrame{frame}, nil
+		}
+	case macroexpandNode:
+		return func(r *runner, env EnvType) (MalType, error) {
+			return r.interp.expand(r.ctx, n, env)
+		}
+	case theEnvNode:
+		return func(r *runner, env EnvType) (MalType, error) {
+			return env, nil
+		}
+	case *tryNode:
+		return try_closure(n, tail)
+	case *doNode:
+		if len(n.body) == 0 {
+			return closure_of(nil, tail)
+		}
+		last := len(n.body) - 1
+		init := closures_of(n.body[:last])
+		end := closure_of(n.body[last], tail)
+		return func(r *runner, env EnvType) (MalType, error) {
+			for _, p := range init {
+				if _, e := p(r, env); e != nil {
+					return nil, e
+				}
+			}
+			return end(r, env)
+		}
+	case *ifNode:
+		cond := closure_of(n.cond, false)
+		then := closure_of(n.then, tail)
+		els := closure_of(n.els, tail)
+		return func(r *runner, env EnvType) (MalType, error) {
+			c, e := cond(r, env)
+			if e != nil {
+				return nil, e
+			}
+			if c == nil || c == false {
+				return els(r, env)
+			}
+			return then(r, env)
+		}
+	case fnNode, multiFnNode:
+		return func(r *runner, env EnvType) (MalType, error) {
+			return r.interp.closure(n, env), nil
+		}
+	case *appNode:
+		fn := closure_of(n.fn, false)
+		args := closures_of(n.args)
+		return func(r *runner, env EnvType) (MalType, error) {
+			f, e := fn(r, env)
+			if e != nil {
+				return nil, e
+			}
+			if mf, ok := f.(MalFunc); ok && mf.GetMacro() {
+				// a macro defined after this call was analyzed
+				node, e := r.interp.reanalyze(r.ctx, n, f, env)
+				if e != nil {
+					return nil, e
+				}
+				return closure_of(node, tail)(r, env)
+			}
+			vals, e := eval_all(r, env, args)
+			if e != nil {
+				return nil, e
+			}
+			if tail {
+				return &tailCall{f, vals}, nil
+			}
+			return r.call(f, vals, nil, nil)
+		}
+	}
+	return func(r *runner, env EnvType) (MalType, error) {
+		return node, nil
+	}
+}
+
+func try_closure(n *tryNode, tail bool) proc {
+	if len(n.catches) == 0 && n.finally == nil {
+		// nothing to catch or clean up, so the body keeps the tail
+		return closure_of(n.body, tail)
+	}
+	body := closure_of(n.body, false)
+	// the handlers run after the try* is done, unless there is a
+	// finally* to run after them
+	handlers := make([]proc, len(n.catches))
+	for i, c := range n.catches {
+		handlers[i] = closure_of(c.handler, tail && n.finally == nil)
+	}
+	var finally proc
+	if n.finally != nil {
+		finally = closure_of(n.finally, false)
+	}
+	return func(r *runner, env EnvType) (MalType, error) {
+		res, err := body(r, env)
+		if err != nil && len(handlers) > 0 {
+			c, exc, e := r.interp.find_catch(r.ctx, n, err, env)
+			if c == nil {
+				err = e
+			} else {
+				for i, clause := range n.catches {
+					if clause == c {
+						frame := NewFrame(env, c.names, []MalType{exc, ErrorStack(err)})
+						res, err = handlers[i](r, frame)
+					}
+				}
+			}
+		}
+		if finally != nil {
+			if _, e := finally(r, env); e != nil {
+				return nil, e
+			}
+		}
+		return res, err
+	}
+}
+
+// Count a step against the evaluation's budget
+func (r *runner) step() error {
+	return r.ev.step()
+}
+
+// Apply f to args, or if lam is not nil run its body in env, one call
+// deeper
+func (r *runner) call(f MalType, args []MalType, lam *lambda, env EnvType) (MalType, error) {
+	if r.max_depth > 0 && r.depth >= r.max_depth {
+		return nil, LimitError(fmt.Sprintf("maximum evaluation depth of %d exceeded", r.max_depth))
+	}
+	if r.depth > 0 && r.depth%hop_depth == 0 {
+		return r.hop(f, args, lam, env)
+	}
+	r.depth++
+	res, e := r.run(f, args, lam, env)
+	r.depth--
+	return res, e
+}
+
+// Make the call on a new goroutine, with a stack of its own
+func (r *runner) hop(f MalType, args []MalType, lam *lambda, env EnvType) (MalType, error) {
+	var res MalType
+	var e error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.depth++
+		res, e = r.run(f, args, lam, env)
+		r.depth--
+	}()
+	<-done
+	return res, e
+}
+
+// Make the call, and then the tail calls it ends with. A fn* whose body
+// is running is named in the stack trace of an error.
+func (r *runner) run(f MalType, args []MalType, lam *lambda, env EnvType) (MalType, error) {
+	var current *lambda
+	elided := 0
+	var res MalType
+	var e error
+	for {
+		if lam == nil {
+			if e = r.step(); e != nil {
+				break
+			}
+			lam, env, res, e = r.apply(f, args)
+		}
+		if lam != nil && e == nil {
+			if current != nil {
+				elided++
+			}
+			current = lam
+			body := lam.target.compiled_closure()
+			for {
+				res, e = body(r, env)
+				rf, ok := res.(*recurFrame)
+				if e != nil || !ok {
+					break
+				}
+				if e = r.step(); e != nil {
+					break
+				}
+				env = rf.env
+			}
+			lam = nil
+		}
+		// calls builtins left, with what to do with the result
+		for e == nil {
+			c, ok := res.(*Call)
+			if !ok || c.Then == nil {
+				break
+			}
+			var val MalType
+			if val, e = r.call(c.Fn, c.Args, nil, nil); e == nil {
+				res, e = c.Then(val)
+			}
+		}
+		if e != nil {
+			break
+		}
+		switch c := res.(type) {
+		case *tailCall:
+			f, args = c.fn, c.args
+		case *Call:
+			f, args = c.Fn, c.Args
+		default:
+			return res, nil
+		}
+	}
+	if current != nil {
+		e = AddFrame(e, current.frame_name())
+		if elided > 0 {
+			e = AddFrame(e, fmt.Sprintf("... %d more elided by tail calls", elided))
+		}
+	}
+	return nil, e
+}
+
+// Apply f to args: the body to run and its frame if f is a fn*, or
+// else the result
+func (r *runner) apply(f MalType, args []MalType) (*lambda, EnvType, MalType, error) {
+	if mf, ok := f.(*MultiFn); ok {
+		// call the method in its place
+		var e error
+		if f, e = r.interp.method(r.ctx, mf, args); e != nil {
+			return nil, nil, nil, e
+		}
+	}
+	switch fn := f.(type) {
+	case MalFunc:
+		var lam *lambda
+		var env *Env
+		var e error
+		switch exp := fn.Exp.(type) {
+		case *arities:
+			if lam, e = exp.pick(len(args)); e == nil {
+				env, e = lam.bind(r.ctx, fn.Env, args)
+			}
+		case *lambda:
+			lam = exp
+			env, e = lam.bind(r.ctx, fn.Env, args)
+		default:
+			res, e := r.interp.apply(r.ctx, fn, args)
+			return nil, nil, res, e
+		}
+		if e != nil {
+			return nil, nil, nil, e
+		}
+		return lam, env, nil, nil
+	case Func:
+		res, e := fn.StepIn(r.ctx, args)
+		return nil, nil, res, e
+	case *MultiFn:
+		res, e := r.interp.apply(r.ctx, fn, args)
+		return nil, nil, res, e
+	default:
+		return nil, nil, nil, TypeError("attempt to call non-function")
+	}
+}
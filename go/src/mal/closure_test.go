@@ -0,0 +1,64 @@
+package mal
+
+import (
+	"testing"
+)
+
+import (
+	"printer"
+)
+
+// Programs whose value or error every evaluator must agree on
+var agreement_programs = []string{
+	// macros defined after the code that uses them, with recur and in
+	// tail position
+	`(def! f (fn* [n] (loop* [i 0 acc []] (if (< i n) (late-loop i acc) acc))))
+	 (defmacro! late-loop (fn* [i acc] ` + "`" + `(recur (+ ~i 1) (conj ~acc ~i))))
+	 (f 5)`,
+	`(def! h (fn* [n] (if (= n 0) :done (late-tail n))))
+	 (defmacro! late-tail (fn* [n] ` + "`" + `(h (- ~n 1))))
+	 (h 100000)`,
+	`(def! log (atom []))
+	 [(try* (throw "x") (catch* e (str "caught " e)) (finally* (swap! log conj :fin)))
+	  (try* (try* (throw 1) (finally* (swap! log conj :inner))) (catch* e [:outer e]))
+	  @log]`,
+	`(def! ^:dynamic *d* 1)
+	 (def! rd (fn* [] *d*))
+	 [(binding [*d* 2] (rd)) (rd) (try* (binding [*d* 3] (throw (rd))) (catch* e [e (rd)]))]`,
+	`(def! ^:dynamic *d* 1)
+	 [(binding [*d* 2] (set! *d* (+ *d* 1)) *d*) *d* @(future *d*) (binding [*d* 2] @(future *d*))]`,
+	`(def! mf (fn* ([] 0) ([x] x) ([x & more] (apply mf more))))
+	 [(mf) (mf 7) (mf 1 2 3) (map (fn* [x] (* x x)) [1 2 3])]`,
+	`(def! deep (fn* [n] (if (= n 0) 0 (+ 1 (deep (- n 1))))))
+	 (deep 100000)`,
+	`(def! thrower (fn* [x] (throw x)))
+	 (def! mid (fn* [x] (thrower x)))
+	 (try* (do (mid :boom) 1) (catch* e *stacktrace*))`,
+	`[(loop* [[a b] [1 2] n 3] (if (> n 0) (recur [b a] (- n 1)) [a b]))
+	  ((fn* [{:keys [p q]}] (+ p q)) {:p 1 :q 2})
+	  (eval '(let* [x 1 y (+ x 1)] [x y]))]`,
+	`(defmulti area (fn* [s] (get s :shape)))
+	 (defmethod area :sq [s] (* (get s :w) (get s :w)))
+	 (area {:shape :sq :w 3})`,
+	`((fn* [a b] a) 1)`,
+	`(undefined-thing)`,
+}
+
+func TestEvaluatorsAgree(t *testing.T) {
+	for _, src := range agreement_programs {
+		want := ""
+		for i, ev := range evaluators {
+			res, e := eval_with(t, Options{Evaluator: ev.ev}, src)
+			got := printer.Pr_str(res, true)
+			if e != nil {
+				got = "error: " + e.Error()
+			}
+			if i == 0 {
+				want = got
+			} else if got != want {
+				t.Errorf("%s disagrees with %s on %s:\ngot  %s\nwant %s",
+					ev.name, evaluators[0].name, src, got, want)
+			}
+		}
+	}
+}
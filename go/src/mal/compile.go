@@ -0,0 +1,317 @@
+package mal
+
+import (
+	"fmt"
+)
+
+import (
+	. "types"
+)
+
+// The bytecode compiler. It works on the nodes analysis makes, so
+// macros are already expanded and local symbols already resolved to
+// (depth, slot) pairs in the frames of fn*, let* and catch*, which are
+// the VM's local slots. A node is compiled to code that leaves its
+// value on the operand stack or, in tail position, returns it; a call
+// in tail position replaces the caller's frame, and a recur jumps back
+// to the start of its loop* or fn* body.
+
+type opcode uint8
+
+const (
+	opConst       opcode = iota // push consts[arg]
+	opLocal                     // push the slot locals[arg]
+	opGlobal                    // push the value of globals[arg]
+	opPop                       // drop the top value
+	opJump                      // continue at arg
+	opJumpIfFalse               // pop a value, continue at arg if it is nil or false
+	opVector                    // pop arg values into a vector
+	opHashMap                   // pop values for the keys of the hashMapNode nodes[arg]
+	opDef                       // def! the top value, as the defNode nodes[arg] says
+	opSet                       // set! the var of the setNode nodes[arg] to the top value
+	opClosure                   // push the function the fn* node nodes[arg] makes
+	opMacroexpand               // push the expansion the macroexpandNode nodes[arg] asks for
+	opTheEnv                    // push the environment
+	opLet                       // enter a frame for the let* or loop* nodes[arg]
+	opStore                     // pop a value into slot arg of the innermost frame
+	opLeave                     // leave the innermost frame
+	opRecur                     // pop the arguments of the recurOp nodes[arg] and jump
+	opCheckMacro                // expand the appOp nodes[arg] if the top value is a macro
+	opCall                      // pop a function and arg arguments, push the result
+	opTailCall                  // the same, replacing the frame if the function has a body
+	opReturn                    // pop a value and return it from the frame
+	opBindVars                  // push the vars the bindingNode nodes[arg] binds
+	opBind                      // pop the vars and their values and bind them
+	opUnbind                    // undo the innermost binding
+	opTry                       // catch errors for the tryOp nodes[arg]
+	opFinally                   // run the finally* of the tryOp nodes[arg] on errors
+	opEndTry                    // stop catching errors
+	opRaise                     // pop an error and raise it
+)
+
+// An instruction: the opcode in the low byte and its argument above it
+type instr uint32
+
+const max_arg = 1<<24 - 1
+
+func (i instr) op() opcode {
+	return opcode(i & 0xff)
+}
+
+func (i instr) arg() int {
+	return int(i >> 8)
+}
+
+// Compiled code, with the operands that do not fit in an instruction
+type chunk struct {
+	code    []instr
+	consts  []MalType
+	locals  []localRef
+	globals []globalRef
+	nodes   []MalType
+	cache   []globalCache // for each of globals
+}
+
+// A recur, and where in the chunk its target's body starts, or -1 if
+// it is in another chunk
+type recurOp struct {
+	n  *recurNode
+	pc int
+}
+
+// An application, and where to continue once the function turns out
+// to be a macro and the expansion is done
+type appOp struct {
+	n     *appNode
+	after int
+	tail  bool
+}
+
+// A try*, and where its catch* handlers and the finally* run when an
+// error is raised start
+type tryOp struct {
+	n       *tryNode
+	catches []int
+	fin_err int
+}
+
+type compiler struct {
+	c      *chunk
+	labels map[*recurTarget]int
+	err    error
+}
+
+// Compile a node to code that returns its value. If t is not nil, the
+// node is t's body, which a recur to t restarts.
+func compile(node MalType, t *recurTarget) (*chunk, error) {
+	cp := &compiler{c: &chunk{}, labels: map[*recurTarget]int{}}
+	if t != nil {
+		cp.labels[t] = 0
+	}
+	cp.compile(node, true)
+	if cp.err != nil {
+		return nil, cp.err
+	}
+	cp.c.cache = make([]globalCache, len(cp.c.globals))
+	return cp.c, nil
+}
+
+// The code for the body of a loop* or fn*, compiled the first time it
+// is needed
+func (t *recurTarget) compiled() (*chunk, error) {
+	t.once.Do(func() {
+		t.code, t.err = compile(t.body, t)
+	})
+	return t.code, t.err
+}
+
+func (cp *compiler) emit(op opcode, arg int) int {
+	if arg < 0 || arg > max_arg {
+		cp.err = LimitError(fmt.Sprintf("too large to compile: operand %d", arg))
+		arg = 0
+	}
+	cp.c.code = append(cp.c.code, instr(op)|instr(arg)<<8)
+	return len(cp.c.code) - 1
+}
+
+// Point the jump at pc to where the next instruction will go
+func (cp *compiler) patch(pc int) {
+	cp.c.code[pc] = instr(cp.c.code[pc].op()) | instr(len(cp.c.code))<<8
+}
+
+func (cp *compiler) node(n MalType) int {
+	cp.c.nodes = append(cp.c.nodes, n)
+	return len(cp.c.nodes) - 1
+}
+
+func (cp *compiler) compile_all(nodes []MalType) {
+	for _, n := range nodes {
+		cp.compile(n, false)
+	}
+}
+
+func (cp *compiler) compile(node MalType, tail bool) {
+	c := cp.c
+	switch n := node.(type) {
+	case localRef:
+		c.locals = append(c.locals, n)
+		cp.emit(opLocal, len(c.locals)-1)
+	case globalRef:
+		c.globals = append(c.globals, n)
+		cp.emit(opGlobal, len(c.globals)-1)
+	case quoteNode:
+		c.consts = append(c.consts, n.val)
+		cp.emit(opConst, len(c.consts)-1)
+	case vectorNode:
+		cp.compile_all(n.items)
+		cp.emit(opVector, len(n.items))
+	case hashMapNode:
+		cp.compile_all(n.items)
+		cp.emit(opHashMap, cp.node(n))
+	case *defNode:
+		cp.compile(n.val, false)
+		cp.emit(opDef, cp.node(n))
+	case *setNode:
+		cp.compile(n.val, false)
+		cp.emit(opSet, cp.node(n))
+	case *bindingNode:
+		i := cp.node(n)
+		cp.emit(opBindVars, i)
+		cp.compile_all(n.inits)
+		cp.emit(opBind, i)
+		cp.compile(n.body, false)
+		cp.emit(opUnbind, 0)
+	case *letNode:
+		cp.emit(opLet, cp.node(n))
+		for i, init := range n.inits {
+			cp.compile(init, false)
+			cp.emit(opStore, n.slots[i])
+		}
+		if n.target != nil {
+			cp.labels[n.target] = len(c.code)
+		}
+		cp.compile(n.body, tail)
+		if !tail {
+			cp.emit(opLeave, 0)
+		}
+		return
+	case *recurNode:
+		cp.compile_all(n.args)
+		pc, ok := cp.labels[n.target]
+		if !ok {
+			pc = -1
+		}
+		cp.emit(opRecur, cp.node(recurOp{n, pc}))
+		return
+	case macroexpandNode:
+		cp.emit(opMacroexpand, cp.node(n))
+	case theEnvNode:
+		cp.emit(opTheEnv, 0)
+	case *tryNode:
+		cp.compile_try(n, tail)
+		return
+	case *doNode:
+		if len(n.body) == 0 {
+			cp.compile(nil, tail)
+			return
+		}
+		last := len(n.body) - 1
+		for _, form := range n.body[:last] {
+			cp.compile(form, false)
+			cp.emit(opPop, 0)
+		}
+		cp.compile(n.body[last], tail)
+		return
+	case *ifNode:
+		cp.compile(n.cond, false)
+		els := cp.emit(opJumpIfFalse, 0)
+		cp.compile(n.then, tail)
+		if tail {
+			cp.patch(els)
+			cp.compile(n.els, true)
+			return
+		}
+		end := cp.emit(opJump, 0)
+		cp.patch(els)
+		cp.compile(n.els, false)
+		cp.patch(end)
+	case fnNode, multiFnNode:
+		cp.emit(opClosure, cp.node(n))
+	case *appNode:
+		cp.compile(n.fn, false)
+		op := &appOp{n: n, tail: tail}
+		cp.emit(opCheckMacro, cp.node(op))
+		cp.compile_all(n.args)
+		if tail {
+			// returns here only if the function was a builtin
+			cp.emit(opTailCall, len(n.args))
+			cp.emit(opReturn, 0)
+			return
+		}
+		cp.emit(opCall, len(n.args))
+		op.after = len(c.code)
+	default:
+		c.consts = append(c.consts, n)
+		cp.emit(opConst, len(c.consts)-1)
+	}
+	if tail {
+		cp.emit(opReturn, 0)
+	}
+}
+
+// The body runs with an opTry catching errors for the catch* clauses,
+// inside an opFinally for the finally*. The finally* is compiled twice,
+// for when the body or a handler returns and for when one raises.
+func (cp *compiler) compile_try(n *tryNode, tail bool) {
+	if len(n.catches) == 0 && n.finally == nil {
+		// nothing to catch or clean up, so the body keeps the tail
+		cp.compile(n.body, tail)
+		return
+	}
+	c := cp.c
+	op := &tryOp{n: n}
+	i := cp.node(op)
+	ret := tail
+	if n.finally != nil {
+		cp.emit(opFinally, i)
+		tail = false
+	}
+	if len(n.catches) > 0 {
+		cp.emit(opTry, i)
+	}
+	cp.compile(n.body, false)
+	ends := []int{}
+	if len(n.catches) > 0 {
+		cp.emit(opEndTry, 0)
+		ends = append(ends, cp.emit(opJump, 0))
+		for _, clause := range n.catches {
+			op.catches = append(op.catches, len(c.code))
+			cp.compile(clause.handler, tail)
+			if !tail {
+				cp.emit(opLeave, 0)
+				ends = append(ends, cp.emit(opJump, 0))
+			}
+		}
+		for _, end := range ends {
+			cp.patch(end)
+		}
+	}
+	if n.finally == nil {
+		if tail {
+			cp.emit(opReturn, 0)
+		}
+		return
+	}
+	cp.emit(opEndTry, 0)
+	cp.compile(n.finally, false)
+	cp.emit(opPop, 0)
+	end := cp.emit(opJump, 0)
+	op.fin_err = len(c.code)
+	cp.compile(n.finally, false)
+	cp.emit(opPop, 0)
+	cp.emit(opRaise, 0)
+	cp.patch(end)
+	if ret {
+		cp.emit(opReturn, 0)
+	}
+}
@@ -0,0 +1,216 @@
+package mal
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+import (
+	"printer"
+	. "types"
+)
+
+// Conversion between mal values and the Go values registered functions
+// take and return
+
+func conv_error(val MalType, t reflect.Type) error {
+	return TypeError(fmt.Sprintf("cannot use %s as %s", printer.Pr_str(val, true), t))
+}
+
+// Keywords convert to Go strings without their marker
+func go_string(val MalType) (string, bool) {
+	s, ok := val.(string)
+	if ok && Keyword_Q(s) {
+		s = s[2:]
+	}
+	return s, ok
+}
+
+// Convert a mal value to a Go value of type t, structs as Unmarshal
+// does
+func to_go(val MalType, t reflect.Type) (reflect.Value, error) {
+	if val == nil {
+		switch t.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Map, reflect.Func:
+			return reflect.Zero(t), nil
+		}
+		return reflect.Value{}, conv_error(val, t)
+	}
+	if h, ok := val.(Handle); ok {
+		if hv := reflect.ValueOf(h.Val); hv.IsValid() && hv.Type().AssignableTo(t) {
+			return hv, nil
+		}
+		return reflect.Value{}, conv_error(val, t)
+	}
+	if s, ok := go_string(val); ok && t.Kind() == reflect.String {
+		return reflect.ValueOf(s).Convert(t), nil
+	}
+	v := reflect.ValueOf(val)
+	if v.Type().AssignableTo(t) {
+		return v, nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := val.(int)
+		if !ok || reflect.Zero(t).OverflowInt(int64(i)) {
+			return reflect.Value{}, conv_error(val, t)
+		}
+		return reflect.ValueOf(i).Convert(t), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := val.(int)
+		if !ok || i < 0 || reflect.Zero(t).OverflowUint(uint64(i)) {
+			return reflect.Value{}, conv_error(val, t)
+		}
+		return reflect.ValueOf(uint64(i)).Convert(t), nil
+	case reflect.Float32, reflect.Float64:
+		switch n := val.(type) {
+		case int:
+			return reflect.ValueOf(float64(n)).Convert(t), nil
+		case float64:
+			return reflect.ValueOf(n).Convert(t), nil
+		}
+	case reflect.String:
+		if sym, ok := val.(Symbol); ok {
+			return reflect.ValueOf(sym.Val).Convert(t), nil
+		}
+	case reflect.Slice:
+		if s, ok := val.(string); ok && t.Elem().Kind() == reflect.Uint8 {
+			return reflect.ValueOf([]byte(s)).Convert(t), nil
+		}
+		slc, e := GetSlice(val)
+		if e != nil {
+			break
+		}
+		res := reflect.MakeSlice(t, len(slc), len(slc))
+		for i, item := range slc {
+			iv, e := to_go(item, t.Elem())
+			if e != nil {
+				return reflect.Value{}, e
+			}
+			res.Index(i).Set(iv)
+		}
+		return res, nil
+	case reflect.Map:
+		hm, ok := val.(HashMap)
+		if !ok || t.Key().Kind() != reflect.String {
+			break
+		}
+		res := reflect.MakeMapWithSize(t, len(hm.Val))
+		for k, item := range hm.Val {
+			iv, e := to_go(item, t.Elem())
+			if e != nil {
+				return reflect.Value{}, e
+			}
+			ks, _ := go_string(k)
+			res.SetMapIndex(reflect.ValueOf(ks).Convert(t.Key()), iv)
+		}
+		return res, nil
+	case reflect.Struct:
+		res := reflect.New(t)
+		if e := unmarshal(val, res.Elem(), t.String()); e != nil {
+			return reflect.Value{}, e
+		}
+		return res.Elem(), nil
+	}
+	return reflect.Value{}, conv_error(val, t)
+}
+
+// Convert a Go value to a mal value. Structs are converted as Marshal
+// does, functions are wrapped as WrapFunc does and values with no mal
+// equivalent are kept as handles. Unsigned integers too large for an
+// int are an error.
+func from_go(v reflect.Value) (MalType, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt {
+			return nil, TypeError(fmt.Sprintf("%d is too large for an int", v.Uint()))
+		}
+		return int(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			return string(v.Bytes()), nil
+		}
+		lst := make([]MalType, v.Len())
+		for i := range lst {
+			item, e := from_go(v.Index(i))
+			if e != nil {
+				return nil, e
+			}
+			lst[i] = item
+		}
+		return Vector{lst, nil}, nil
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		hm := HashMap{map[string]MalType{}, nil}
+		iter := v.MapRange()
+		for iter.Next() {
+			item, e := from_go(iter.Value())
+			if e != nil {
+				return nil, e
+			}
+			hm.Val[iter.Key().String()] = item
+		}
+		return hm, nil
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Kind() == reflect.Interface {
+			return from_go(v.Elem())
+		}
+	case reflect.Func:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return WrapFunc(v.Type().String(), v.Interface())
+	case reflect.Struct:
+		if !is_mal_type(v.Type()) {
+			if m, e := marshal(v, visits{}); e == nil {
+				return m, nil
+			}
+		}
+	}
+	if is_mal_type(v.Type()) {
+		return v.Interface(), nil
+	}
+	return Handle{v.Interface()}, nil
+}
+
+// The mal name for a Go method, so ToUpper is to-upper and ReadHTTP is
+// read-http
+func mal_name(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		upper := r >= 'A' && r <= 'Z'
+		if upper && i > 0 {
+			prev := rune(name[i-1])
+			next_lower := i+1 < len(name) && name[i+1] >= 'a' && name[i+1] <= 'z'
+			if !(prev >= 'A' && prev <= 'Z') || next_lower {
+				sb.WriteByte('-')
+			}
+		}
+		if upper {
+			r += 'a' - 'A'
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,214 @@
+package mal
+
+import (
+	"fmt"
+	"sort"
+)
+
+import (
+	"printer"
+	. "types"
+)
+
+// Destructuring. Binding forms take patterns where they take symbols,
+// and the analyzer expands each pattern into plain symbol bindings:
+//
+//	[a b & rest :as all]   by position, rest a list of the others
+//	{:keys [a b] :strs [c] :or {:b 1} :as m}
+//	                       by keyword or string key, with defaults
+//	                       for missing keys keyed by the name bound
+//
+// Map keys are strings or keywords, so the defaults are keyed by the
+// name as a keyword, :or {:b 1}, or as a string, :or {"b" 1}, rather
+// than by the symbol itself as in Clojure's :or {b 1}.
+//
+// Patterns nest, and a map pattern also takes a sequence of keys and
+// values, such as the rest of a function's arguments. A value too
+// short for a sequential pattern binds the missing names to nil, as
+// does a map without a key.
+
+// The builtins expansions call, referred to by value so that they work
+// whatever the names nth and get are bound to
+
+var destructure_nth = Func{func(a []MalType) (MalType, error) {
+	if a[0] == nil {
+		return nil, nil
+	}
+	slc, e := GetSlice(a[0])
+	if e != nil {
+		return nil, TypeError("cannot destructure " + printer.Pr_str(a[0], true) + " as a sequence")
+	}
+	if i := a[1].(int); i < len(slc) {
+		return slc[i], nil
+	}
+	return nil, nil
+}, nil}
+
+var destructure_rest = Func{func(a []MalType) (MalType, error) {
+	if a[0] == nil {
+		return List{[]MalType{}, nil}, nil
+	}
+	slc, e := GetSlice(a[0])
+	if e != nil {
+		return nil, TypeError("cannot destructure " + printer.Pr_str(a[0], true) + " as a sequence")
+	}
+	if i := a[1].(int); i < len(slc) {
+		return List{slc[i:], nil}, nil
+	}
+	return List{[]MalType{}, nil}, nil
+}, nil}
+
+var destructure_get = Func{func(a []MalType) (MalType, error) {
+	if a[0] == nil {
+		return a[2], nil
+	}
+	entries, ok := MapEntries(a[0])
+	if !ok && Sequential_Q(a[0]) {
+		// the rest of the arguments, as keyword arguments
+		m, e := NewHashMap(a[0])
+		if e == nil {
+			entries, ok = m.(HashMap).Val, true
+		}
+	}
+	if !ok {
+		return nil, TypeError("cannot destructure " + printer.Pr_str(a[0], true) + " as a map")
+	}
+	if val, ok := entries[a[1].(string)]; ok {
+		return val, nil
+	}
+	return a[2], nil
+}, nil}
+
+func is_keyword(val MalType, name string) bool {
+	s, ok := val.(string)
+	return ok && Keyword_Q(s) && s[2:] == name
+}
+
+// Expands patterns into symbol bindings, naming the intermediate
+// values prefix__1, prefix__2 and so on
+type destructurer struct {
+	n     int
+	binds []MalType
+}
+
+func (d *destructurer) temp(prefix string) Symbol {
+	d.n++
+	return Symbol{fmt.Sprintf("%s__%d", prefix, d.n)}
+}
+
+// Whether a binding form needs expanding
+func is_pattern(pat MalType) bool {
+	switch pat.(type) {
+	case Vector, HashMap:
+		return true
+	}
+	return false
+}
+
+// Expand the pairs of a binding vector, leaving plain symbol bindings
+// as they are
+func destructure(binds []MalType) ([]MalType, error) {
+	d := &destructurer{}
+	for i := 0; i < len(binds); i += 2 {
+		if e := d.bind(binds[i], binds[i+1]); e != nil {
+			return nil, e
+		}
+	}
+	return d.binds, nil
+}
+
+func (d *destructurer) bind(pat MalType, val MalType) error {
+	switch p := pat.(type) {
+	case Symbol:
+		d.binds = append(d.binds, p, val)
+		return nil
+	case Vector:
+		return d.bind_seq(p.Val, val)
+	case HashMap:
+		return d.bind_map(p, val)
+	}
+	return TypeError("cannot bind " + printer.Pr_str(pat, true))
+}
+
+func (d *destructurer) bind_seq(pats []MalType, val MalType) error {
+	v := d.temp("vec")
+	d.binds = append(d.binds, v, val)
+	n := 0
+	for i := 0; i < len(pats); i++ {
+		switch {
+		case Symbol_Q(pats[i]) && pats[i].(Symbol).Val == "&":
+			if i+1 >= len(pats) {
+				return TypeError("& must be followed by a binding form")
+			}
+			i++
+			rest := List{[]MalType{destructure_rest, v, n}, nil}
+			if e := d.bind(pats[i], rest); e != nil {
+				return e
+			}
+		case is_keyword(pats[i], "as"):
+			if i+1 >= len(pats) || !Symbol_Q(pats[i+1]) {
+				return TypeError(":as must be followed by a symbol")
+			}
+			i++
+			d.binds = append(d.binds, pats[i], v)
+		default:
+			item := List{[]MalType{destructure_nth, v, n}, nil}
+			if e := d.bind(pats[i], item); e != nil {
+				return e
+			}
+			n++
+		}
+	}
+	return nil
+}
+
+func (d *destructurer) bind_map(pat HashMap, val MalType) error {
+	m := d.temp("map")
+	d.binds = append(d.binds, m, val)
+	defaults := HashMap{map[string]MalType{}, nil}
+	keys := []string{}
+	for k, v := range pat.Val {
+		switch {
+		case is_keyword(k, "as"):
+			if !Symbol_Q(v) {
+				return TypeError(":as must be followed by a symbol")
+			}
+			d.binds = append(d.binds, v, m)
+		case is_keyword(k, "or"):
+			hm, ok := v.(HashMap)
+			if !ok {
+				return TypeError(":or must be followed by a map")
+			}
+			defaults = hm
+		case is_keyword(k, "keys"), is_keyword(k, "strs"):
+			keys = append(keys, k)
+		default:
+			return TypeError("unsupported map destructuring key " + printer.Pr_str(k, true))
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		names, e := GetSlice(pat.Val[k])
+		if e != nil {
+			return TypeError(printer.Pr_str(k, true) + " must be followed by a vector of symbols")
+		}
+		for _, name := range names {
+			sym, ok := name.(Symbol)
+			if !ok {
+				return TypeError(printer.Pr_str(k, true) + " must be followed by a vector of symbols")
+			}
+			kw, _ := NewKeyword(sym.Val)
+			key := sym.Val
+			if is_keyword(k, "keys") {
+				key = kw.(string)
+			}
+			def, ok := defaults.Val[kw.(string)]
+			if !ok {
+				def = defaults.Val[sym.Val]
+			}
+			get := List{[]MalType{destructure_get, m, key, def}, nil}
+			d.binds = append(d.binds, sym, get)
+		}
+	}
+	return nil
+}
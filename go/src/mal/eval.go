@@ -0,0 +1,807 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+)
+
+import (
+	. "env"
+	. "types"
+)
+
+func is_pair(x MalType) bool {
+	slc, e := GetSlice(x)
+	if e != nil {
+		return false
+	}
+	return len(slc) > 0
+}
+
+func quasiquote(ast MalType) MalType {
+	if !is_pair(ast) {
+		return List{[]MalType{Symbol{"quote"}, ast}, nil}
+	} else {
+		slc, _ := GetSlice(ast)
+		a0 := slc[0]
+		if Symbol_Q(a0) && (a0.(Symbol).Val == "unquote") {
+			return slc[1]
+		} else if is_pair(a0) {
+			slc0, _ := GetSlice(a0)
+			a00 := slc0[0]
+			if Symbol_Q(a00) && (a00.(Symbol).Val == "splice-unquote") {
+				return List{[]MalType{Symbol{"concat"},
+					slc0[1],
+					quasiquote(List{slc[1:], nil})}, nil}
+			}
+		}
+		return List{[]MalType{Symbol{"cons"},
+			quasiquote(a0),
+			quasiquote(List{slc[1:], nil})}, nil}
+	}
+}
+
+func is_macro_call(ast MalType, env EnvType) bool {
+	if List_Q(ast) {
+		slc, _ := GetSlice(ast)
+		if len(slc) == 0 {
+			return false
+		}
+		a0 := slc[0]
+		if Symbol_Q(a0) && env.Find(a0.(Symbol)) != nil {
+			mac, e := env.Get(a0.(Symbol))
+			if e != nil {
+				return false
+			}
+			if MalFunc_Q(mac) {
+				return mac.(MalFunc).GetMacro()
+			}
+		}
+	}
+	return false
+}
+
+// Expand ast until it is no longer a macro call
+func (interp *Interpreter) macroexpand(ctx context.Context, ast MalType, env EnvType) (MalType, error) {
+	for {
+		exp, expanded, e := interp.macroexpand_1(ctx, ast, env)
+		if e != nil || !expanded {
+			return exp, e
+		}
+		ast = exp
+	}
+}
+
+// Expand ast once if it is a macro call, tracing the step if
+// *trace-macros* is true
+func (interp *Interpreter) macroexpand_1(ctx context.Context, ast MalType, env EnvType) (MalType, bool, error) {
+	if !is_macro_call(ast, env) {
+		return ast, false, nil
+	}
+	slc, _ := GetSlice(ast)
+	mac, e := env.Get(slc[0].(Symbol))
+	if e != nil {
+		return nil, false, e
+	}
+	exp, e := interp.apply(ctx, mac, slc[1:])
+	if e != nil {
+		return nil, false, e
+	}
+	if e := interp.trace_expansion(ctx, ast, exp); e != nil {
+		return nil, false, e
+	}
+	return exp, true, nil
+}
+
+func (interp *Interpreter) eval(ctx context.Context, ast MalType, env EnvType) (MalType, error) {
+	node, e := interp.analyze(ctx, ast, nil, env)
+	if e != nil {
+		return nil, e
+	}
+	if e := check_recur(node, false); e != nil {
+		return nil, e
+	}
+	return interp.exec(ctx, node, env)
+}
+
+// The evaluator. exec keeps what is left to do with the value of the
+// node it is evaluating on a stack of continuations, rather than on
+// Go's stack, so that recursion is limited by memory, or by
+// Options.MaxDepth, and not by the size of a goroutine's stack. A node
+// in tail position is evaluated without pushing a continuation, which
+// makes tail calls take no space at all. Builtins that call functions
+// leave the calls to the evaluator (see types.Call); a call through
+// Apply from Go starts a stack of its own.
+
+type contKind uint8
+
+const (
+	contVector      contKind = iota // evaluating item i
+	contHashMap                     // evaluating item i
+	contDef                         // evaluating the value
+	contSet                         // evaluating the value
+	contBindingInit                 // evaluating init i
+	contBinding                     // the body, after which the bindings are undone
+	contLet                         // evaluating init i
+	contRecur                       // evaluating arg i
+	contDo                          // evaluating body form i
+	contIf                          // evaluating the condition
+	contFn                          // evaluating the function of an application
+	contArgs                        // evaluating arg i of an application
+	contTry                         // the body of a try* with catch* clauses
+	contFinally                     // the body of a try* with a finally*
+	contFinallyDone                 // the finally*, after which the saved value or error is the result
+	contThen                        // a call a builtin left, whose result goes to then
+	contCall                        // a function body, named in stack traces
+)
+
+// Kept small, as there is one for every level of recursion. Some kinds
+// use fields for other things, as noted.
+type cont struct {
+	kind contKind
+	i    int       // which of its nodes is being evaluated, or the tail calls elided
+	node MalType   // the node waiting for the value, or the error to raise
+	env  EnvType   // where it is evaluated
+	vals []MalType // the values of those before it
+	fn   MalType   // the function applied, the lambda, the value to return, then, or the context to restore
+}
+
+const (
+	evaluating = iota // node in env
+	returning         // val
+	raising           // err
+)
+
+type machine struct {
+	interp    *Interpreter
+	ctx       context.Context // of the evaluation it is part of
+	ev        *evaluation
+	stack     []cont
+	max_depth int
+	mode      int
+	node      MalType
+	env       EnvType
+	val       MalType
+	err       error
+}
+
+func (interp *Interpreter) exec(ctx context.Context, node MalType, env EnvType) (MalType, error) {
+	switch interp.evaluator {
+	case Bytecode:
+		return interp.run_vm(ctx, node, env)
+	case Closures:
+		return interp.run_closures(ctx, node, env)
+	}
+	m := machine{interp: interp, ctx: ctx, ev: evaluation_of(ctx), max_depth: interp.max_depth, node: node, env: env}
+	return m.run()
+}
+
+// Apply f to args as Apply does, but in ctx, for the calls made from Go
+// during an evaluation: of macros, catch* predicates, dispatch
+// functions, and the functions builtins run later or elsewhere
+func (interp *Interpreter) apply(ctx context.Context, f MalType, args []MalType) (MalType, error) {
+	switch fn := f.(type) {
+	case MalFunc:
+		if lam, ok := fn.Exp.(*lambda); ok {
+			env, e := lam.bind(ctx, fn.Env, args)
+			if e != nil {
+				return nil, e
+			}
+			return interp.exec(ctx, lam, env)
+		}
+		env, e := fn.GenEnv(fn.Env, fn.Params, List{args, nil})
+		if e != nil {
+			return nil, e
+		}
+		return interp.exec(ctx, fn.Exp, env)
+	case Func:
+		res, e := fn.StepIn(ctx, args)
+		for e == nil {
+			c, ok := res.(*Call)
+			if !ok {
+				break
+			}
+			res, e = interp.apply(ctx, c.Fn, c.Args)
+			if e == nil && c.Then != nil {
+				res, e = c.Then(res)
+			}
+		}
+		return res, e
+	case *MultiFn:
+		method, e := interp.method(ctx, fn, args)
+		if e != nil {
+			return nil, e
+		}
+		return interp.apply(ctx, method, args)
+	}
+	return Apply(f, args)
+}
+
+// The method of mf to call for args
+func (interp *Interpreter) method(ctx context.Context, mf *MultiFn, args []MalType) (MalType, error) {
+	val, e := interp.apply(ctx, mf.Dispatch, args)
+	if e != nil {
+		return nil, e
+	}
+	return mf.MethodFor(val)
+}
+
+func (m *machine) eval(node MalType, env EnvType) {
+	m.mode, m.node, m.env = evaluating, node, env
+}
+
+func (m *machine) result(val MalType, e error) {
+	if e != nil {
+		m.mode, m.err = raising, e
+	} else {
+		m.mode, m.val = returning, val
+	}
+}
+
+// Evaluate node after pushing k, to continue with its value
+func (m *machine) push(k cont, node MalType, env EnvType) {
+	m.stack = append(m.stack, k)
+	m.eval(node, env)
+}
+
+func (m *machine) pop() cont {
+	k := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return k
+}
+
+func (m *machine) run() (MalType, error) {
+	for {
+		switch m.mode {
+		case evaluating:
+			m.step()
+		case returning:
+			if len(m.stack) == 0 {
+				return m.val, nil
+			}
+			m.resume(m.pop())
+		case raising:
+			if len(m.stack) == 0 {
+				return nil, m.err
+			}
+			m.unwind(m.pop())
+		}
+	}
+}
+
+// Evaluate m.node, by finding its value or starting on its parts
+func (m *machine) step() {
+	if e := m.ev.step(); e != nil {
+		m.result(nil, e)
+		return
+	}
+	if m.max_depth > 0 && len(m.stack) > m.max_depth {
+		m.result(nil, LimitError(fmt.Sprintf("maximum evaluation depth of %d exceeded", m.max_depth)))
+		return
+	}
+	env := m.env
+	switch n := m.node.(type) {
+	case localRef:
+		if val, ok := env.(*Env).Slot(n.depth, n.slot); ok {
+			m.result(val, nil)
+			return
+		}
+		// not bound yet (a later let* binding), so behave
+		// as though the slot were not there
+		m.result(lookup_var(m.ctx, env, n.sym))
+	case globalRef:
+		if f, ok := env.(*Env); ok {
+			m.result(lookup_var(m.ctx, f.Up(n.depth), n.sym))
+			return
+		}
+		m.result(lookup_var(m.ctx, env, n.sym))
+	case quoteNode:
+		m.result(n.val, nil)
+	case vectorNode:
+		k := cont{kind: contVector, node: n, env: env, vals: make([]MalType, len(n.items))}
+		if m.fill(&k, n.items) {
+			m.result(Vector{k.vals, nil}, nil)
+		}
+	case hashMapNode:
+		k := cont{kind: contHashMap, node: n, env: env, vals: make([]MalType, len(n.items))}
+		if m.fill(&k, n.items) {
+			m.result(new_hash_map(n.keys, k.vals), nil)
+		}
+	case *defNode:
+		m.push(cont{kind: contDef, node: n, env: env}, n.val, env)
+	case *setNode:
+		m.push(cont{kind: contSet, node: n, env: env}, n.val, env)
+	case *bindingNode:
+		// the vars, then the values they are bound to
+		vals := make([]MalType, 2*len(n.syms))
+		for i, sym := range n.syms {
+			v, e := dynamic_var(env, sym)
+			if e != nil {
+				m.result(nil, e)
+				return
+			}
+			vals[i] = v
+		}
+		m.bind(cont{kind: contBindingInit, node: n, env: env, vals: vals})
+	case *letNode:
+		let_env := NewFrame(env, n.names, nil)
+		if len(n.inits) == 0 {
+			m.eval(n.body, let_env)
+			return
+		}
+		m.push(cont{kind: contLet, node: n, env: let_env}, n.inits[0], let_env)
+	case *recurNode:
+		k := cont{kind: contRecur, node: n, env: env, vals: make([]MalType, len(n.args))}
+		if m.fill(&k, n.args) {
+			m.recur(n, env, k.vals)
+		}
+	case macroexpandNode:
+		m.result(m.interp.expand(m.ctx, n, env))
+	case theEnvNode:
+		m.result(env, nil)
+	case *tryNode:
+		if n.finally != nil {
+			m.stack = append(m.stack, cont{kind: contFinally, node: n, env: env})
+		}
+		if len(n.catches) > 0 {
+			m.stack = append(m.stack, cont{kind: contTry, node: n, env: env})
+		}
+		m.eval(n.body, env)
+	case *doNode:
+		switch len(n.body) {
+		case 0:
+			m.result(nil, nil)
+		case 1:
+			m.eval(n.body[0], env)
+		default:
+			m.push(cont{kind: contDo, node: n, env: env}, n.body[0], env)
+		}
+	case *ifNode:
+		cond, ok, e := leaf(m.ctx, n.cond, env)
+		switch {
+		case e != nil:
+			m.result(nil, e)
+		case !ok:
+			m.push(cont{kind: contIf, node: n, env: env}, n.cond, env)
+		case cond == nil || cond == false:
+			m.eval(n.els, env)
+		default:
+			m.eval(n.then, env)
+		}
+	case fnNode, multiFnNode:
+		m.result(m.interp.closure(n, env), nil)
+	case *arities:
+		// a multi-arity MalFunc called through Apply
+		f := env.(*Env)
+		args, _ := f.Slot(0, 0)
+		lam, e := n.pick(len(args.(List).Val))
+		if e != nil {
+			m.result(nil, e)
+			return
+		}
+		if env, e = lam.bind(m.ctx, f.Up(1), args.(List).Val); e != nil {
+			m.result(nil, e)
+			return
+		}
+		m.eval(lam, env)
+	case *lambda:
+		// body of a MalFunc, its frame already made by gen_env. A
+		// tail call replaces the function on top of the stack.
+		if top := len(m.stack) - 1; top >= 0 && m.stack[top].kind == contCall {
+			m.stack[top].fn = n
+			m.stack[top].i++
+		} else {
+			m.stack = append(m.stack, cont{kind: contCall, fn: n})
+		}
+		m.eval(n.code, env)
+	case *appNode:
+		f, ok, e := leaf(m.ctx, n.fn, env)
+		switch {
+		case e != nil:
+			m.result(nil, e)
+		case !ok:
+			m.push(cont{kind: contFn, node: n, env: env}, n.fn, env)
+		default:
+			m.apply(n, env, f)
+		}
+	default:
+		m.result(n, nil)
+	}
+}
+
+// Continue k with the value m.val
+func (m *machine) resume(k cont) {
+	val := m.val
+	switch k.kind {
+	case contVector:
+		n := k.node.(vectorNode)
+		k.vals[k.i] = val
+		k.i++
+		if m.fill(&k, n.items) {
+			m.result(Vector{k.vals, nil}, nil)
+		}
+	case contHashMap:
+		n := k.node.(hashMapNode)
+		k.vals[k.i] = val
+		k.i++
+		if m.fill(&k, n.items) {
+			m.result(new_hash_map(n.keys, k.vals), nil)
+		}
+	case contDef:
+		m.result(define(k.node.(*defNode), k.env, val))
+	case contSet:
+		m.result(set_var(m.ctx, k.node.(*setNode), k.env, val))
+	case contBindingInit:
+		k.vals[len(k.vals)/2+k.i] = val
+		k.i++
+		m.bind(k)
+	case contBinding:
+		m.ctx = k.fn.(context.Context)
+		m.result(val, nil)
+	case contLet:
+		n := k.node.(*letNode)
+		k.env.(*Env).SetSlot(n.slots[k.i], val)
+		if k.i+1 < len(n.inits) {
+			k.i++
+			m.push(k, n.inits[k.i], k.env)
+			return
+		}
+		m.eval(n.body, k.env)
+	case contRecur:
+		n := k.node.(*recurNode)
+		k.vals[k.i] = val
+		k.i++
+		if m.fill(&k, n.args) {
+			m.recur(n, k.env, k.vals)
+		}
+	case contDo:
+		n := k.node.(*doNode)
+		k.i++
+		if k.i == len(n.body)-1 {
+			m.eval(n.body[k.i], k.env)
+			return
+		}
+		m.push(k, n.body[k.i], k.env)
+	case contIf:
+		n := k.node.(*ifNode)
+		if val == nil || val == false {
+			m.eval(n.els, k.env)
+		} else {
+			m.eval(n.then, k.env)
+		}
+	case contFn:
+		m.apply(k.node.(*appNode), k.env, val)
+	case contArgs:
+		n := k.node.(*appNode)
+		k.vals[k.i] = val
+		k.i++
+		if m.fill(&k, n.args) {
+			m.call(k.fn, k.vals)
+		}
+	case contFinally:
+		n := k.node.(*tryNode)
+		m.push(cont{kind: contFinallyDone, fn: val}, n.finally, k.env)
+	case contFinallyDone:
+		if k.node != nil {
+			m.result(nil, k.node.(error))
+			return
+		}
+		m.result(k.fn, nil)
+	case contThen:
+		m.result(k.fn.(func(MalType) (MalType, error))(val))
+		if c, ok := m.val.(*Call); ok && m.mode == returning {
+			m.call_for(c)
+		}
+	default: // contTry, contCall
+		m.result(val, nil)
+	}
+}
+
+// Continue k with the error m.err, which a try* may catch
+func (m *machine) unwind(k cont) {
+	err := m.err
+	switch k.kind {
+	case contBinding:
+		m.ctx = k.fn.(context.Context)
+	case contTry:
+		n := k.node.(*tryNode)
+		c, exc, e := m.interp.find_catch(m.ctx, n, err, k.env)
+		if c == nil {
+			m.err = e
+			return
+		}
+		m.eval(c.handler, NewFrame(k.env, c.names, []MalType{exc, ErrorStack(err)}))
+	case contFinally:
+		n := k.node.(*tryNode)
+		m.push(cont{kind: contFinallyDone, node: err}, n.finally, k.env)
+	case contCall:
+		m.err = AddFrame(err, k.fn.(*lambda).frame_name())
+		if k.i > 0 {
+			m.err = AddFrame(m.err, fmt.Sprintf("... %d more elided by tail calls", k.i))
+		}
+	}
+}
+
+// The value of a node that needs no evaluating beyond looking it up, if
+// it is one
+func leaf(ctx context.Context, node MalType, env EnvType) (MalType, bool, error) {
+	switch n := node.(type) {
+	case localRef:
+		if val, ok := env.(*Env).Slot(n.depth, n.slot); ok {
+			return val, true, nil
+		}
+		return nil, false, nil
+	case globalRef:
+		var val MalType
+		var e error
+		if f, ok := env.(*Env); ok {
+			val, e = lookup_var(ctx, f.Up(n.depth), n.sym)
+		} else {
+			val, e = lookup_var(ctx, env, n.sym)
+		}
+		return val, true, e
+	case quoteNode:
+		return n.val, true, nil
+	case nil, bool, int, string:
+		return n, true, nil
+	}
+	return nil, false, nil
+}
+
+// Evaluate the nodes of k from the ith on into its vals, stopping to
+// push k at the first that is not a leaf. Returns whether they are all
+// done.
+func (m *machine) fill(k *cont, nodes []MalType) bool {
+	for ; k.i < len(nodes); k.i++ {
+		val, ok, e := leaf(m.ctx, nodes[k.i], k.env)
+		if e != nil {
+			m.result(nil, e)
+			return false
+		}
+		if !ok {
+			m.push(*k, nodes[k.i], k.env)
+			return false
+		}
+		k.vals[k.i] = val
+	}
+	return true
+}
+
+func new_hash_map(keys []string, vals []MalType) HashMap {
+	hm := HashMap{make(map[string]MalType, len(keys)), nil}
+	for i, key := range keys {
+		hm.Val[key] = vals[i]
+	}
+	return hm
+}
+
+// Apply the value of an application's function to its arguments, once
+// they are evaluated
+func (m *machine) apply(n *appNode, env EnvType, f MalType) {
+	if MalFunc_Q(f) && f.(MalFunc).GetMacro() {
+		// a macro defined after this call was analyzed
+		m.result(m.interp.reanalyze(m.ctx, n, f, env))
+		if m.mode == returning {
+			m.eval(m.val, env)
+		}
+		return
+	}
+	k := cont{kind: contArgs, node: n, env: env, fn: f, vals: make([]MalType, len(n.args))}
+	if m.fill(&k, n.args) {
+		m.call(f, k.vals)
+	}
+}
+
+// Bind the vars of a binding once the values are all evaluated
+func (m *machine) bind(k cont) {
+	n := k.node.(*bindingNode)
+	if k.i < len(n.inits) {
+		m.push(k, n.inits[k.i], k.env)
+		return
+	}
+	nvars := len(k.vals) / 2
+	vals := make(map[*Var]MalType, nvars)
+	for i, v := range k.vals[:nvars] {
+		vals[v.(*Var)] = k.vals[nvars+i]
+	}
+	m.push(cont{kind: contBinding, fn: m.ctx}, n.body, k.env)
+	m.ctx = Bind(m.ctx, vals)
+}
+
+func (m *machine) recur(n *recurNode, env EnvType, vals []MalType) {
+	t := n.target
+	frame := NewFrame(env.(*Env).Outer(n.depth), t.scope.names, nil)
+	for i, val := range vals {
+		frame.SetSlot(t.slots[i], val)
+	}
+	m.eval(t.body, frame)
+}
+
+// Apply f to args, in tail position
+func (m *machine) call(f MalType, args []MalType) {
+	if mf, ok := f.(*MultiFn); ok {
+		// call the method in its place
+		var e error
+		if f, e = m.interp.method(m.ctx, mf, args); e != nil {
+			m.result(nil, e)
+			return
+		}
+	}
+	switch fn := f.(type) {
+	case MalFunc:
+		var lam *lambda
+		var env *Env
+		var e error
+		switch exp := fn.Exp.(type) {
+		case *arities:
+			if lam, e = exp.pick(len(args)); e == nil {
+				env, e = lam.bind(m.ctx, fn.Env, args)
+			}
+		case *lambda:
+			lam = exp
+			env, e = lam.bind(m.ctx, fn.Env, args)
+		default:
+			m.result(m.interp.apply(m.ctx, fn, args))
+			return
+		}
+		if e != nil {
+			m.result(nil, e)
+			return
+		}
+		m.eval(lam, env)
+	case Func:
+		m.result(fn.StepIn(m.ctx, args))
+		if c, ok := m.val.(*Call); ok && m.mode == returning {
+			m.call_for(c)
+		}
+	case *MultiFn:
+		m.result(m.interp.apply(m.ctx, fn, args))
+	default:
+		m.result(nil, TypeError("attempt to call non-function"))
+	}
+}
+
+// Make the call a builtin left, continuing with what it does with the
+// result
+func (m *machine) call_for(c *Call) {
+	if c.Then != nil {
+		m.stack = append(m.stack, cont{kind: contThen, fn: c.Then})
+	}
+	m.call(c.Fn, c.Args)
+}
+
+// The node for an application whose function turned out to be a macro
+// defined after it was analyzed
+func (interp *Interpreter) reanalyze(ctx context.Context, n *appNode, mac MalType, env EnvType) (MalType, error) {
+	ast, e := interp.apply(ctx, mac, n.form.Val[1:])
+	if e != nil {
+		return nil, e
+	}
+	if e := interp.trace_expansion(ctx, n.form, ast); e != nil {
+		return nil, e
+	}
+	if ast, e = interp.macroexpand(ctx, ast, env); e != nil {
+		return nil, e
+	}
+	node, e := interp.analyze(ctx, ast, n.scope, env)
+	if e != nil {
+		return nil, e
+	}
+	if e := check_recur(node, n.tail); e != nil {
+		return nil, e
+	}
+	return node, nil
+}
+
+// The function a fn* node makes in env
+func (interp *Interpreter) closure(node MalType, env EnvType) MalType {
+	if n, ok := node.(multiFnNode); ok {
+		return MalFunc{interp.exec_fn, n.ar, env, nil, false, n.ar.gen_env, nil}
+	}
+	lam := node.(fnNode).lam
+	return MalFunc{interp.exec_fn, lam, env, lam.params, false, lam.gen_env, nil}
+}
+
+func define(n *defNode, env EnvType, res MalType) (MalType, error) {
+	if n.macro {
+		fn, ok := res.(MalFunc)
+		if !ok {
+			return nil, TypeError("defmacro! requires a function")
+		}
+		res = fn.SetMacro()
+	}
+	if v := own_var(env, n.sym); v != nil {
+		v.SetRoot(res)
+		return res, nil
+	}
+	if n.dynamic {
+		env.Set(n.sym, NewVar(var_name(env, n.sym), res))
+		return res, nil
+	}
+	return env.Set(n.sym, res), nil
+}
+
+func set_var(ctx context.Context, n *setNode, env EnvType, val MalType) (MalType, error) {
+	found, e := env.Get(n.sym)
+	if e != nil {
+		return nil, e
+	}
+	v, ok := found.(*Var)
+	if !ok {
+		return nil, TypeError("set! requires a dynamic var, not " + n.sym.Val)
+	}
+	return val, v.Set(ctx, val)
+}
+
+// The var a binding rebinds
+func dynamic_var(env EnvType, sym Symbol) (*Var, error) {
+	found, e := env.Get(sym)
+	if e != nil {
+		return nil, e
+	}
+	v, ok := found.(*Var)
+	if !ok {
+		return nil, TypeError("cannot bind " + sym.Val + ", which is not a dynamic var")
+	}
+	return v, nil
+}
+
+// Globals that are dynamic vars evaluate to their binding in ctx
+func var_value(ctx context.Context, val MalType) MalType {
+	if v, ok := val.(*Var); ok {
+		return v.Get(ctx)
+	}
+	return val
+}
+
+func lookup_var(ctx context.Context, env EnvType, sym Symbol) (MalType, error) {
+	val, e := env.Get(sym)
+	return var_value(ctx, val), e
+}
+
+func var_name(env EnvType, sym Symbol) string {
+	if ns, ok := env.(*Namespace); ok {
+		return ns.Name + "/" + sym.Val
+	}
+	return sym.Val
+}
+
+// The dynamic var a def! in env redefines, if there is one. A var
+// referred from another namespace is not redefined but shadowed.
+func own_var(env EnvType, sym Symbol) *Var {
+	if env.Find(sym) != env {
+		return nil
+	}
+	val, _ := env.Get(sym)
+	v, ok := val.(*Var)
+	if !ok || v.Name != var_name(env, sym) {
+		return nil
+	}
+	return v
+}
+
+// The first catch* clause of a try* that matches an error, and the
+// value it binds. If none matches, the error is returned as it is.
+func (interp *Interpreter) find_catch(ctx context.Context, n *tryNode, err error, env EnvType) (*catchClause, MalType, error) {
+	exc := ErrorValue(err)
+	for _, c := range n.catches {
+		if c.category != "" && c.category != ErrorCategory(err) {
+			continue
+		}
+		if c.pred != nil {
+			pred, e := interp.exec(ctx, c.pred, env)
+			if e != nil {
+				return nil, nil, e
+			}
+			match, e := interp.apply(ctx, pred, []MalType{exc})
+			if e != nil {
+				return nil, nil, e
+			}
+			if match == nil || match == false {
+				continue
+			}
+		}
+		return c, exc, nil
+	}
+	return nil, nil, err
+}
@@ -0,0 +1,316 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+)
+
+import (
+	"printer"
+	. "types"
+)
+
+// Macro expansion for debugging. macroexpand expands a form until it is
+// no longer a macro call, macroexpand-1 expands it once, and
+// macroexpand-all expands every macro call in it as analysis would:
+// not in quoted data, nor where a local binding shadows the macro, and
+// leaving the names that fn*, let* and the like bind alone. While
+// *trace-macros* is true, each step of every expansion, including those
+// analysis makes, is written to *out* as the form before and after.
+
+func (interp *Interpreter) expand(ctx context.Context, n macroexpandNode, env EnvType) (MalType, error) {
+	switch n.how {
+	case "macroexpand-1":
+		exp, _, e := interp.macroexpand_1(ctx, n.form, env)
+		return exp, e
+	case "macroexpand-all":
+		return interp.macroexpand_all(ctx, n.form, env, nil)
+	}
+	return interp.macroexpand(ctx, n.form, env)
+}
+
+func (interp *Interpreter) trace_expansion(ctx context.Context, before MalType, after MalType) error {
+	if interp.trace_macros == nil {
+		return nil
+	}
+	if on := interp.trace_macros.Get(ctx); on == nil || on == false {
+		return nil
+	}
+	w, e := interp.out_writer(ctx)
+	if e != nil {
+		return e
+	}
+	_, e = fmt.Fprintf(w, ";; %s\n;; => %s\n",
+		printer.Pr_str(before, true), printer.Pr_str(after, true))
+	return e
+}
+
+// The names bound locally around a form, which macros of the same name
+// do not apply to
+type locals map[string]bool
+
+// locals with the symbols in a binding form, a symbol or a
+// destructuring pattern, added
+func (ls locals) with(binding MalType) locals {
+	added := locals{}
+	for name := range ls {
+		added[name] = true
+	}
+	var add func(MalType)
+	add = func(form MalType) {
+		switch f := form.(type) {
+		case Symbol:
+			added[f.Val] = true
+		case Vector:
+			for _, item := range f.Val {
+				add(item)
+			}
+		case List:
+			for _, item := range f.Val {
+				add(item)
+			}
+		case HashMap:
+			for _, v := range f.Val {
+				add(v)
+			}
+		}
+	}
+	add(binding)
+	return added
+}
+
+func (interp *Interpreter) macroexpand_all(ctx context.Context, form MalType, env EnvType, ls locals) (MalType, error) {
+	switch f := form.(type) {
+	case Vector:
+		items, e := interp.macroexpand_each(ctx, f.Val, env, ls)
+		if e != nil {
+			return nil, e
+		}
+		return Vector{items, f.Meta}, nil
+	case HashMap:
+		hm := HashMap{make(map[string]MalType, len(f.Val)), f.Meta}
+		for k, v := range f.Val {
+			exp, e := interp.macroexpand_all(ctx, v, env, ls)
+			if e != nil {
+				return nil, e
+			}
+			hm.Val[k] = exp
+		}
+		return hm, nil
+	case List:
+		if len(f.Val) == 0 {
+			return f, nil
+		}
+		if sym, ok := f.Val[0].(Symbol); !ok || !ls[sym.Val] {
+			exp, e := interp.macroexpand(ctx, f, env)
+			if e != nil {
+				return nil, e
+			}
+			lst, ok := exp.(List)
+			if !ok || len(lst.Val) == 0 {
+				return interp.macroexpand_all(ctx, exp, env, ls)
+			}
+			f = lst
+		}
+		return interp.macroexpand_list(ctx, f, env, ls)
+	}
+	return form, nil
+}
+
+func (interp *Interpreter) macroexpand_each(ctx context.Context, forms []MalType, env EnvType, ls locals) ([]MalType, error) {
+	exps := make([]MalType, len(forms))
+	for i, form := range forms {
+		exp, e := interp.macroexpand_all(ctx, form, env, ls)
+		if e != nil {
+			return nil, e
+		}
+		exps[i] = exp
+	}
+	return exps, nil
+}
+
+// Expand the parts of a list that is not a macro call, given the
+// special form it is
+func (interp *Interpreter) macroexpand_list(ctx context.Context, lst List, env EnvType, ls locals) (MalType, error) {
+	a0sym := ""
+	if sym, ok := lst.Val[0].(Symbol); ok && !ls[sym.Val] {
+		a0sym = sym.Val
+	}
+	forms := append([]MalType{}, lst.Val...)
+	// expand forms from the ith on, seeing ls
+	rest := func(i int, ls locals) (MalType, error) {
+		if i < len(forms) {
+			exps, e := interp.macroexpand_each(ctx, forms[i:], env, ls)
+			if e != nil {
+				return nil, e
+			}
+			copy(forms[i:], exps)
+		}
+		return List{forms, lst.Meta}, nil
+	}
+	switch a0sym {
+	case "quote", "macroexpand", "macroexpand-1", "macroexpand-all":
+		return lst, nil
+	case "quasiquote":
+		if len(forms) > 1 {
+			exp, e := interp.macroexpand_quasi(ctx, forms[1], env, ls, 1)
+			if e != nil {
+				return nil, e
+			}
+			forms[1] = exp
+		}
+		return List{forms, lst.Meta}, nil
+	case "def!", "defmacro!", "set!":
+		return rest(2, ls)
+	case "let*", "loop*", "binding":
+		if len(forms) > 1 {
+			binds, e := GetSlice(forms[1])
+			if e != nil {
+				return rest(1, ls)
+			}
+			exps := make([]MalType, len(binds))
+			body_ls := ls
+			for i := 0; i < len(binds); i++ {
+				if i%2 == 0 {
+					exps[i] = binds[i]
+					if a0sym != "binding" {
+						body_ls = body_ls.with(binds[i])
+					}
+					continue
+				}
+				if exps[i], e = interp.macroexpand_all(ctx, binds[i], env, body_ls); e != nil {
+					return nil, e
+				}
+			}
+			forms[1] = Vector{exps, nil}
+			if List_Q(lst.Val[1]) {
+				forms[1] = List{exps, nil}
+			}
+			return rest(2, body_ls)
+		}
+	case "fn*":
+		if is_multi_arity(forms[1:]) {
+			for i, clause := range forms[1:] {
+				c := clause.(List)
+				exp, e := interp.macroexpand_fn(ctx, c.Val, env, ls)
+				if e != nil {
+					return nil, e
+				}
+				forms[i+1] = List{exp, c.Meta}
+			}
+			return List{forms, lst.Meta}, nil
+		}
+		if len(forms) > 1 {
+			exp, e := interp.macroexpand_fn(ctx, forms[1:], env, ls)
+			if e != nil {
+				return nil, e
+			}
+			copy(forms[1:], exp)
+			return List{forms, lst.Meta}, nil
+		}
+	case "try*":
+		for i := 1; i < len(forms); i++ {
+			clause, ok := forms[i].(List)
+			if !ok || !is_clause(clause, "catch*") {
+				continue
+			}
+			// (catch* e handler) or (catch* pred e handler)
+			vals := append([]MalType{}, clause.Val...)
+			sym := 1
+			if len(vals) == 4 {
+				sym = 2
+				exp, e := interp.macroexpand_all(ctx, vals[1], env, ls)
+				if e != nil {
+					return nil, e
+				}
+				vals[1] = exp
+			}
+			if sym+1 < len(vals) {
+				exps, e := interp.macroexpand_each(ctx, vals[sym+1:], env, ls.with(vals[sym]))
+				if e != nil {
+					return nil, e
+				}
+				copy(vals[sym+1:], exps)
+			}
+			forms[i] = List{vals, clause.Meta}
+		}
+		for i := 1; i < len(forms); i++ {
+			if is_clause(forms[i], "catch*") {
+				continue
+			}
+			if is_clause(forms[i], "finally*") {
+				clause := forms[i].(List)
+				exps, e := interp.macroexpand_each(ctx, clause.Val[1:], env, ls)
+				if e != nil {
+					return nil, e
+				}
+				forms[i] = List{append([]MalType{clause.Val[0]}, exps...), clause.Meta}
+				continue
+			}
+			exp, e := interp.macroexpand_all(ctx, forms[i], env, ls)
+			if e != nil {
+				return nil, e
+			}
+			forms[i] = exp
+		}
+		return List{forms, lst.Meta}, nil
+	}
+	return rest(0, ls)
+}
+
+// The parameters and body of a fn*, with the body expanded
+func (interp *Interpreter) macroexpand_fn(ctx context.Context, forms []MalType, env EnvType, ls locals) ([]MalType, error) {
+	body, e := interp.macroexpand_each(ctx, forms[1:], env, ls.with(forms[0]))
+	if e != nil {
+		return nil, e
+	}
+	return append([]MalType{forms[0]}, body...), nil
+}
+
+// Expand only the unquoted parts of a quasiquote template, depth levels
+// of quasiquote in
+func (interp *Interpreter) macroexpand_quasi(ctx context.Context, form MalType, env EnvType, ls locals, depth int) (MalType, error) {
+	lst, ok := form.(List)
+	if !ok {
+		if vec, ok := form.(Vector); ok {
+			items, e := interp.macroexpand_quasi_each(ctx, vec.Val, env, ls, depth)
+			if e != nil {
+				return nil, e
+			}
+			return Vector{items, vec.Meta}, nil
+		}
+		return form, nil
+	}
+	if len(lst.Val) == 2 {
+		switch {
+		case is_clause(lst, "unquote"), is_clause(lst, "splice-unquote"):
+			if depth == 1 {
+				exp, e := interp.macroexpand_all(ctx, lst.Val[1], env, ls)
+				if e != nil {
+					return nil, e
+				}
+				return List{[]MalType{lst.Val[0], exp}, lst.Meta}, nil
+			}
+			depth--
+		case is_clause(lst, "quasiquote"):
+			depth++
+		}
+	}
+	items, e := interp.macroexpand_quasi_each(ctx, lst.Val, env, ls, depth)
+	if e != nil {
+		return nil, e
+	}
+	return List{items, lst.Meta}, nil
+}
+
+func (interp *Interpreter) macroexpand_quasi_each(ctx context.Context, forms []MalType, env EnvType, ls locals, depth int) ([]MalType, error) {
+	exps := make([]MalType, len(forms))
+	for i, form := range forms {
+		exp, e := interp.macroexpand_quasi(ctx, form, env, ls, depth)
+		if e != nil {
+			return nil, e
+		}
+		exps[i] = exp
+	}
+	return exps, nil
+}
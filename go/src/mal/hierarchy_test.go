@@ -0,0 +1,33 @@
+package mal
+
+import (
+	"sync"
+	"testing"
+)
+
+import (
+	. "types"
+)
+
+// Derivations made at once in opposite directions cannot make a cycle
+func TestConcurrentDerive(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		h := NewHierarchy()
+		var a, b MalType = "a", "b"
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for _, pair := range [][2]MalType{{a, b}, {b, a}} {
+			wg.Add(1)
+			go func(child, parent MalType) {
+				defer wg.Done()
+				<-start
+				h.Derive(child, parent)
+			}(pair[0], pair[1])
+		}
+		close(start)
+		wg.Wait()
+		if h.Isa(a, b) && h.Isa(b, a) {
+			t.Fatalf("both %v and %v derive from each other", a, b)
+		}
+	}
+}
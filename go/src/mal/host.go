@@ -0,0 +1,132 @@
+package mal
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	. "types"
+)
+
+// Host interop. Mal code can call the Go functions an interpreter has
+// been allowed by name, as (go/call "strings.ToUpper" "abc"). Go values
+// with no mal equivalent come back as handles, and their methods are
+// called with (. handle Method args...).
+
+// A selection of the standard library for Options.Host
+var StdHost = map[string]interface{}{
+	"strings.Contains":   strings.Contains,
+	"strings.Fields":     strings.Fields,
+	"strings.HasPrefix":  strings.HasPrefix,
+	"strings.HasSuffix":  strings.HasSuffix,
+	"strings.Index":      strings.Index,
+	"strings.Join":       strings.Join,
+	"strings.Repeat":     strings.Repeat,
+	"strings.ReplaceAll": strings.ReplaceAll,
+	"strings.Split":      strings.Split,
+	"strings.ToLower":    strings.ToLower,
+	"strings.ToUpper":    strings.ToUpper,
+	"strings.TrimSpace":  strings.TrimSpace,
+	"strings.NewReader":  strings.NewReader,
+	"strconv.Atoi":       strconv.Atoi,
+	"strconv.Itoa":       strconv.Itoa,
+	"strconv.Quote":      strconv.Quote,
+	"math.Abs":           math.Abs,
+	"math.Floor":         math.Floor,
+	"math.Pow":           math.Pow,
+	"math.Sqrt":          math.Sqrt,
+	"filepath.Base":      filepath.Base,
+	"filepath.Dir":       filepath.Dir,
+	"filepath.Ext":       filepath.Ext,
+	"filepath.Join":      filepath.Join,
+	"os.Create":          os.Create,
+	"os.CreateTemp":      os.CreateTemp,
+	"os.Getenv":          os.Getenv,
+	"os.Open":            os.Open,
+	"os.ReadFile":        os.ReadFile,
+	"os.Remove":          os.Remove,
+	"os.WriteFile":       os.WriteFile,
+	"time.Now":           time.Now,
+	"time.Sleep":         time.Sleep,
+}
+
+// The capability each StdHost function needs, if it is not pure
+var host_capability = map[string]string{
+	"os.Create":     "io-write",
+	"os.CreateTemp": "io-write",
+	"os.Getenv":     "os",
+	"os.Open":       "io-read",
+	"os.ReadFile":   "io-read",
+	"os.Remove":     "io-write",
+	"os.WriteFile":  "io-write",
+	"time.Now":      "time",
+	"time.Sleep":    "time",
+}
+
+// Let mal code call a Go function through go/call. The name is usually
+// the function's qualified Go name.
+func (interp *Interpreter) AllowHost(name string, fn interface{}) error {
+	f, e := WrapFunc(name, fn)
+	if e != nil {
+		return e
+	}
+	interp.host_mu.Lock()
+	defer interp.host_mu.Unlock()
+	interp.host[name] = f
+	return nil
+}
+
+// Names are given as strings or symbols
+func host_name(val MalType) (string, bool) {
+	if sym, ok := val.(Symbol); ok {
+		return sym.Val, true
+	}
+	s, ok := val.(string)
+	return s, ok && !Keyword_Q(s)
+}
+
+// (go/call "strings.ToUpper" "abc")
+func (interp *Interpreter) go_call(a []MalType) (MalType, error) {
+	if len(a) < 1 {
+		return nil, ArityError("go/call requires a function name")
+	}
+	name, ok := host_name(a[0])
+	if !ok {
+		return nil, TypeError("go/call requires a function name")
+	}
+	interp.host_mu.RLock()
+	f, ok := interp.host[name]
+	interp.host_mu.RUnlock()
+	if !ok {
+		return nil, NotFoundError("go/call: " + name + " is not an allowed host function")
+	}
+	return f.Call(a[1:])
+}
+
+// (go/method handle 'Method args...), which (. handle Method args...)
+// expands to
+func go_method(a []MalType) (MalType, error) {
+	if len(a) < 2 {
+		return nil, ArityError("go/method requires a handle and a method name")
+	}
+	h, ok := a[0].(Handle)
+	if !ok || h.Val == nil {
+		return nil, TypeError("go/method requires a Go handle")
+	}
+	name, ok := host_name(a[1])
+	if !ok {
+		return nil, TypeError("go/method requires a method name")
+	}
+	m := reflect.ValueOf(h.Val).MethodByName(name)
+	if !m.IsValid() {
+		return nil, NotFoundError(fmt.Sprintf("%T has no method %s", h.Val, name))
+	}
+	return wrap_func(fmt.Sprintf("(%T).%s", h.Val, name), m).Call(a[2:])
+}
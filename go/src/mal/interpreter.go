@@ -0,0 +1,274 @@
+// Package mal is the mal interpreter as a library, for embedding mal
+// as a scripting language in Go programs.
+package mal
+
+import (
+	"context"
+	"sync"
+)
+
+import (
+	"core"
+	. "env"
+	"printer"
+	"reader"
+	. "types"
+)
+
+// The ways of evaluating analyzed code, all with the same results
+type Evaluator int
+
+const (
+	TreeWalker Evaluator = iota // the machine in eval.go
+	Bytecode                    // compiled by compile.go for the VM in vm.go
+	Closures                    // compiled to Go closures by closure.go
+)
+
+type Options struct {
+	// The command line arguments, for *ARGV*
+	Args []string
+	// Where require looks for namespace files, "." if empty
+	LoadPath []string
+	// The Go functions go/call may call, by name. See StdHost.
+	Host map[string]interface{}
+	// If not zero, how many evaluation steps and how many bytes of
+	// allocation each top-level evaluation may use. See limits.go.
+	MaxSteps int64
+	MaxAlloc uint64
+	// If not zero, how many continuations an evaluation may have
+	// waiting, or frames on the VM, which bounds its depth of
+	// recursion. See eval.go and vm.go.
+	MaxDepth int
+	// What runs the code analysis makes, the tree walker by default
+	Evaluator Evaluator
+	// The capability sets the interpreter has, all of them if nil.
+	// See sandbox.go.
+	Capabilities []string
+}
+
+// An Interpreter is a complete mal environment. Interpreters share no
+// state, so any number of them can be used in one process.
+type Interpreter struct {
+	namespaces *Namespaces
+	// Where the fn* forms in loaded files are, for stack traces.
+	// Keyed by the address of the fn* symbol in the form.
+	locations sync.Map
+	// interp.exec, the Eval of every MalFunc made here, for calls from Go
+	// through Apply, which run outside any evaluation
+	exec_fn   func(MalType, EnvType) (MalType, error)
+	host_mu   sync.RWMutex
+	host      map[string]Func
+	max_steps int64
+	max_alloc uint64
+	max_depth int
+	evaluator Evaluator
+	caps      map[string]bool
+	out       *Var       // *out*, where prn and println write
+	hierarchy *Hierarchy // what derive adds to, for multimethods
+	// *trace-macros*, which when true writes each expansion to *out*
+	trace_macros *Var
+}
+
+// A new interpreter, or an error if opts names an unknown capability or
+// a host function that cannot be called from mal
+func New(opts Options) (*Interpreter, error) {
+	caps, e := capability_set(opts.Capabilities)
+	if e != nil {
+		return nil, e
+	}
+	interp := &Interpreter{
+		namespaces: NewNamespaces("mal.core"),
+		host:       map[string]Func{},
+		max_steps:  opts.MaxSteps,
+		max_alloc:  opts.MaxAlloc,
+		max_depth:  opts.MaxDepth,
+		evaluator:  opts.Evaluator,
+		caps:       caps,
+		hierarchy:  NewHierarchy(),
+	}
+	interp.exec_fn = func(node MalType, env EnvType) (MalType, error) {
+		return interp.exec(context.Background(), node, env)
+	}
+	core_ns := interp.namespaces.Core()
+	interp.set_current_ns(core_ns)
+
+	// core.go: defined using go
+	for k, v := range core.NS {
+		if !interp.allowed(core.Capability[k]) {
+			continue
+		}
+		core_ns.Set(Symbol{k}, Func{v.(func([]MalType) (MalType, error)), nil})
+	}
+	for k, v := range core.Blocking() {
+		core_ns.Set(Symbol{k}, Func{v.(func([]MalType) (MalType, error)), nil})
+	}
+	for k, v := range core.Concurrent(interp.start) {
+		core_ns.Set(Symbol{k}, Func{v.(func([]MalType) (MalType, error)), nil})
+	}
+	for k, v := range core.Stackless() {
+		core_ns.Set(Symbol{k}, Func{v.(func([]MalType) (MalType, error)), nil})
+	}
+	if interp.allowed("io-write") {
+		interp.init_output(core_ns)
+	}
+	core_ns.Set(Symbol{"eval"}, Func{WithContext(func(ctx context.Context, a []MalType) (MalType, error) {
+		env, e := interp.env_arg(a, 1, "eval")
+		if e != nil {
+			return nil, e
+		}
+		return interp.eval(ctx, a[0], env)
+	}), nil})
+	if interp.allowed("io-read") {
+		core_ns.Set(Symbol{"load-file"}, Func{WithContext(interp.load_file), nil})
+	}
+	core_ns.Set(Symbol{"in-ns"}, Func{interp.in_ns, nil})
+	core_ns.Set(Symbol{"require"}, Func{WithContext(interp.require), nil})
+	core_ns.Set(Symbol{"find-ns"}, Func{func(a []MalType) (MalType, error) {
+		sym, ok := a[0].(Symbol)
+		if !ok {
+			return nil, TypeError("find-ns requires a symbol")
+		}
+		if ns := interp.namespaces.Find(sym.Val); ns != nil {
+			return ns, nil
+		}
+		return nil, nil
+	}, nil})
+	core_ns.Set(Symbol{"ns-name"}, Func{func(a []MalType) (MalType, error) {
+		ns, ok := a[0].(*Namespace)
+		if !ok {
+			return nil, TypeError("ns-name requires a namespace")
+		}
+		return Symbol{ns.Name}, nil
+	}, nil})
+	core_ns.Set(Symbol{"resolve"}, Func{interp.resolve, nil})
+	core_ns.Set(Symbol{"bound?"}, Func{interp.bound_Q, nil})
+	core_ns.Set(Symbol{"undef!"}, Func{interp.undef_BANG, nil})
+	core_ns.Set(Symbol{"env-keys"}, Func{interp.env_keys, nil})
+	core_ns.Set(Symbol{"ns-publics"}, Func{interp.ns_publics, nil})
+	core_ns.Set(Symbol{"env?"}, Func{func(a []MalType) (MalType, error) {
+		return Env_Q(a[0]), nil
+	}, nil})
+	interp.init_multi(core_ns)
+	interp.init_records(core_ns)
+	core_ns.Set(Symbol{"sandbox"}, Func{interp.sandbox, nil})
+	core_ns.Set(Symbol{"capabilities"}, Func{interp.capabilities, nil})
+	if interp.allowed("os") {
+		argv := make([]MalType, len(opts.Args))
+		for i, a := range opts.Args {
+			argv[i] = a
+		}
+		core_ns.Set(Symbol{"*ARGV*"}, List{argv, nil})
+	}
+	if interp.allowed("io-read") {
+		load_path := []MalType{}
+		for _, dir := range opts.LoadPath {
+			load_path = append(load_path, dir)
+		}
+		if len(load_path) == 0 {
+			load_path = append(load_path, ".")
+		}
+		core_ns.Set(Symbol{"*load-path*"}, Vector{load_path, nil})
+	}
+
+	// host interop
+	for name, fn := range opts.Host {
+		if !interp.allowed(host_capability[name]) {
+			continue
+		}
+		if e := interp.AllowHost(name, fn); e != nil {
+			return nil, e
+		}
+	}
+	go_ns := interp.namespaces.Intern("go")
+	go_ns.Set(Symbol{"call"}, Func{interp.go_call, nil})
+	go_ns.Set(Symbol{"method"}, Func{go_method, nil})
+	go_ns.Set(Symbol{"handle?"}, Func{func(a []MalType) (MalType, error) {
+		return Handle_Q(a[0]), nil
+	}, nil})
+
+	// core.mal: defined using the language itself
+	ctx := context.Background()
+	interp.Rep(ctx, "(def! *host-language* \"go\")")
+	interp.Rep(ctx, "(def! not (fn* (a) (if a false true)))")
+	interp.Rep(ctx, "(defmacro! cond (fn* (& xs) (if (> (count xs) 0) (list 'if (first xs) (if (> (count xs) 1) (nth xs 1) (throw \"odd number of forms to cond\")) (cons 'cond (rest (rest xs)))))))")
+	interp.Rep(ctx, "(def! *gensym-counter* (atom 0))")
+	interp.Rep(ctx, "(def! gensym (fn* [] (symbol (str \"G__\" (swap! *gensym-counter* (fn* [x] (+ 1 x)))))))")
+	interp.Rep(ctx, "(defmacro! future (fn* (& body) `(future-call (fn* [] (do ~@body)))))")
+	interp.Rep(ctx, "(defmacro! go (fn* (& body) `(go* (fn* [] (do ~@body)))))")
+	interp.Rep(ctx, "(defmacro! or (fn* (& xs) (if (empty? xs) nil (if (= 1 (count xs)) (first xs) (let* (condvar (gensym)) `(let* (~condvar ~(first xs)) (if ~condvar ~condvar (or ~@(rest xs)))))))))")
+	if interp.allowed("io-write") {
+		interp.Rep(ctx, "(defmacro! with-out-str (fn* [& body] (let* [s (gensym)] `(let* [~s (atom \"\")] (do (binding [*out* (fn* [x] (swap! ~s str x))] ~@body) @~s)))))")
+	}
+	interp.Rep(ctx, "(defmacro! defmulti (fn* [name dispatch & opts] `(def! ~name (multi-fn '~name ~dispatch ~@opts))))")
+	interp.Rep(ctx, "(defmacro! defmethod (fn* [name dispatch-val & fn-tail] `(add-method ~name ~dispatch-val (fn* ~@(if (vector? (first fn-tail)) [(first fn-tail) `(do ~@(rest fn-tail))] fn-tail)))))")
+	interp.Rep(ctx, "(defmacro! defprotocol (fn* [name & sigs] `(do (def! ~name (protocol '~name '~(map first sigs))) ~@(map (fn* [s] `(def! ~(first s) (protocol-fn ~name '~(first s)))) sigs) '~name)))")
+	interp.Rep(ctx, "(defmacro! extend-type (fn* [t & specs] `(extend '~t ~@(map (fn* [s] (if (list? s) [`'~(first s) (if (vector? (nth s 1)) `(fn* ~(nth s 1) (do ~@(rest (rest s)))) `(fn* ~@(rest s)))] s)) specs))))")
+	interp.Rep(ctx, "(defmacro! extend-protocol (fn* [p & specs] `(extend ~p ~@(map (fn* [s] (if (list? s) [`'~(first s) (if (vector? (nth s 1)) `(fn* ~(nth s 1) (do ~@(rest (rest s)))) `(fn* ~@(rest s)))] `'~s)) specs))))")
+	interp.Rep(ctx, "(defmacro! defrecord (fn* [name fields & specs] `(do (def! ~name (record-type '~name '~fields)) (def! ~(symbol (str \"->\" name)) (fn* ~fields (new-record ~name ~@fields))) (def! ~(symbol (str \"map->\" name)) (fn* [m] (map->record ~name m))) (extend-type ~name ~@(map (fn* [s] (if (if (list? s) (vector? (nth s 1))) `(~(first s) ~(nth s 1) (let* ~[{:keys fields} (first (nth s 1))] (do ~@(rest (rest s))))) s)) specs)) '~name)))")
+	interp.Rep(ctx, "(defmacro! . (fn* [obj method & args] `(go/method ~obj '~method ~@args)))")
+	interp.Rep(ctx, "(defmacro! ns (fn* [name & clauses] `(do (in-ns '~name) ~@(map (fn* [c] (if (= :require (first c)) `(require ~@(map (fn* [s] `'~s) (rest c))) (throw (str \"unsupported ns clause \" (first c))))) clauses) nil)))")
+
+	interp.set_current_ns(interp.namespaces.Intern("user"))
+	return interp, nil
+}
+
+// Evaluate every form in src in the current namespace, returning the
+// value of the last
+func (interp *Interpreter) EvalString(ctx context.Context, src string) (MalType, error) {
+	forms, e := reader.Read_all(src)
+	if e != nil {
+		return nil, e
+	}
+	ctx, end := interp.begin(ctx)
+	defer end()
+	var res MalType
+	for _, form := range forms {
+		if ctx.Err() != nil {
+			return nil, Cancelled(ctx)
+		}
+		if res, e = interp.eval(ctx, form, interp.current_ns()); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+// Evaluate a file as load-file does
+func (interp *Interpreter) EvalFile(ctx context.Context, path string) (MalType, error) {
+	if ctx.Err() != nil {
+		return nil, Cancelled(ctx)
+	}
+	ctx, end := interp.begin(ctx)
+	defer end()
+	return interp.load_file(ctx, []MalType{path})
+}
+
+// Read one form, evaluate it and print the result, as the REPL does
+func (interp *Interpreter) Rep(ctx context.Context, str string) (string, error) {
+	exp, e := reader.Read_str(str)
+	if e != nil {
+		return "", e
+	}
+	ctx, end := interp.begin(ctx)
+	defer end()
+	if exp, e = interp.eval(ctx, exp, interp.current_ns()); e != nil {
+		return "", e
+	}
+	return printer.Pr_str(exp, true), nil
+}
+
+// Bind a name in the current namespace. Go functions of the same type
+// as the core ones can be passed directly.
+func (interp *Interpreter) Define(name string, value MalType) {
+	if fn, ok := value.(func([]MalType) (MalType, error)); ok {
+		value = Func{fn, nil}
+	}
+	interp.current_ns().Set(Symbol{name}, value)
+}
+
+// Find the value of a name, which may be qualified, as mal code in the
+// current namespace would
+func (interp *Interpreter) Lookup(name string) (MalType, bool) {
+	val, e := interp.current_ns().Get(Symbol{name})
+	return val, e == nil
+}
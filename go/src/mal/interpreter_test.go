@@ -0,0 +1,84 @@
+package mal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+import (
+	. "types"
+)
+
+func TestEmbedding(t *testing.T) {
+	interp, e := New(Options{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	ctx := context.Background()
+	interp.Define("twice", func(a []MalType) (MalType, error) {
+		return a[0].(int) * 2, nil
+	})
+	interp.Define("base", 20)
+	res, e := interp.EvalString(ctx, "(def! answer (+ (twice base) 2)) (str answer)")
+	if e != nil || res != "42" {
+		t.Errorf("EvalString: got %v, %v", res, e)
+	}
+	if v, ok := interp.Lookup("answer"); !ok || v != 42 {
+		t.Errorf("Lookup answer: got %v, %v", v, ok)
+	}
+	if v, ok := interp.Lookup("mal.core/count"); !ok || !Func_Q(v) {
+		t.Errorf("Lookup mal.core/count: got %v, %v", v, ok)
+	}
+	if _, ok := interp.Lookup("no-such-name"); ok {
+		t.Error("Lookup found an undefined name")
+	}
+	if out, e := interp.Rep(ctx, "[answer :k]"); e != nil || out != "[42 :k]" {
+		t.Errorf("Rep: got %v, %v", out, e)
+	}
+	if _, e := interp.EvalString(ctx, "(+ 1"); e == nil {
+		t.Error("EvalString read an unbalanced form")
+	}
+
+	path := filepath.Join(t.TempDir(), "lib.mal")
+	if e := os.WriteFile(path, []byte("(def! from-file (twice answer))\n"), 0o644); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := interp.EvalFile(ctx, path); e != nil {
+		t.Fatal(e)
+	}
+	if v, ok := interp.Lookup("from-file"); !ok || v != 84 {
+		t.Errorf("EvalFile: from-file is %v, %v", v, ok)
+	}
+	if _, e := interp.EvalFile(ctx, filepath.Join(t.TempDir(), "missing.mal")); e == nil || ErrorCategory(e) != "io" {
+		t.Errorf("EvalFile of a missing file: got %v", e)
+	}
+}
+
+// Instances share nothing: not definitions, not the gensym counter
+func TestIndependentInstances(t *testing.T) {
+	a, e := New(Options{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := New(Options{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	ctx := context.Background()
+	if _, e := a.EvalString(ctx, "(def! only-a 1) (def! + -) (gensym) (gensym)"); e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := b.Lookup("only-a"); ok {
+		t.Error("a definition in one instance is visible in another")
+	}
+	if res, e := b.EvalString(ctx, "(+ 1 2)"); e != nil || res != 3 {
+		t.Errorf("a redefinition in one instance changed another: got %v, %v", res, e)
+	}
+	ga, _ := a.EvalString(ctx, "(gensym)")
+	gb, _ := b.EvalString(ctx, "(gensym)")
+	if ga != (Symbol{"G__3"}) || gb != (Symbol{"G__1"}) {
+		t.Errorf("gensym counters are shared: got %v and %v", ga, gb)
+	}
+}
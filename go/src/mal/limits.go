@@ -0,0 +1,125 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"runtime/metrics"
+	"sync/atomic"
+)
+
+import (
+	. "types"
+)
+
+// Cancellation and budgets. Every top-level evaluation, a call of
+// EvalString, EvalFile or Rep, runs in its context with its own step
+// and allocation counts, and fails once the context is done or a
+// budget runs out. The error is catchable, in the cancelled, timeout
+// or limit category, but is raised again at the next step, so a
+// handler can clean up and nothing more.
+//
+// Options.MaxDepth is different: going deeper than it raises an error
+// in the limit category where it happens, which a try* outside can
+// catch and carry on from.
+
+// How many steps pass between checks of the allocation budget, which
+// reading the runtime's metrics makes too slow to check every step
+const alloc_check_interval = 1024
+
+const allocs_metric = "/gc/heap/allocs:bytes"
+
+type evaluation struct {
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	done      <-chan struct{}
+	steps     atomic.Int64
+	holds     atomic.Int64 // the evaluation itself and the work it started
+	max_steps int64
+	max_alloc uint64
+	allocs    uint64 // the process's allocations when it began
+}
+
+// Bytes allocated by the process so far. Goroutines other than the
+// evaluation's count too, so the allocation budget is approximate.
+func heap_allocs() uint64 {
+	sample := []metrics.Sample{{Name: allocs_metric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+type evaluation_key struct{}
+
+// Start a top-level evaluation in ctx, returning the context to run it
+// in, which the evaluators pass along with every call, and the function
+// that ends it. Futures and go blocks it starts count against it and
+// are stopped with it, and it is not over until they are done.
+func (interp *Interpreter) begin(ctx context.Context) (context.Context, func()) {
+	if ctx.Done() == nil && interp.max_steps == 0 && interp.max_alloc == 0 {
+		return ctx, func() {}
+	}
+	ev := &evaluation{max_steps: interp.max_steps, max_alloc: interp.max_alloc}
+	ctx, ev.cancel = context.WithCancelCause(ctx)
+	ev.ctx = context.WithValue(ctx, evaluation_key{}, ev)
+	ev.done = ev.ctx.Done()
+	if ev.max_alloc > 0 {
+		ev.allocs = heap_allocs()
+	}
+	ev.holds.Store(1)
+	return ev.ctx, ev.release
+}
+
+// Keep the evaluation going for work on another goroutine, until the
+// matching release
+func (ev *evaluation) hold() {
+	if ev != nil {
+		ev.holds.Add(1)
+	}
+}
+
+// Let the evaluation end once nothing holds it, releasing its context
+func (ev *evaluation) release() {
+	if ev != nil && ev.holds.Add(-1) == 0 {
+		ev.cancel(nil)
+	}
+}
+
+// Start work on another goroutine for the evaluation ctx belongs to,
+// for the builtins that do. It starts without the bindings in ctx.
+func (interp *Interpreter) start(ctx context.Context) (func(MalType, []MalType) (MalType, error), func()) {
+	ctx = Unbound(ctx)
+	ev := evaluation_of(ctx)
+	ev.hold()
+	return func(f MalType, args []MalType) (MalType, error) {
+		return interp.apply(ctx, f, args)
+	}, ev.release
+}
+
+// The evaluation ctx belongs to, or nil if it cannot be stopped
+func evaluation_of(ctx context.Context) *evaluation {
+	ev, _ := ctx.Value(evaluation_key{}).(*evaluation)
+	return ev
+}
+
+// Count a step of evaluation, failing if the evaluation is over
+func (ev *evaluation) step() error {
+	if ev == nil {
+		return nil
+	}
+	n := ev.steps.Add(1)
+	if ev.max_steps > 0 && n > ev.max_steps {
+		ev.cancel(LimitError(fmt.Sprintf("step budget of %d exceeded", ev.max_steps)))
+	} else if ev.max_alloc > 0 && n%alloc_check_interval == 0 {
+		if heap_allocs()-ev.allocs > ev.max_alloc {
+			ev.cancel(LimitError(fmt.Sprintf("allocation budget of %d bytes exceeded", ev.max_alloc)))
+		}
+	}
+	select {
+	case <-ev.done:
+		return Cancelled(ev.ctx)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,101 @@
+package mal
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+import (
+	. "types"
+)
+
+const spin = "(loop* [i 0] (recur (+ i 1)))"
+
+func TestMaxSteps(t *testing.T) {
+	for _, ev := range evaluators {
+		interp, e := New(Options{Evaluator: ev.ev, MaxSteps: 10000})
+		if e != nil {
+			t.Fatal(e)
+		}
+		if _, e := interp.EvalString(context.Background(), spin); ErrorCategory(e) != "limit" {
+			t.Errorf("%s: got %v, want a limit error", ev.name, e)
+		}
+		// the next evaluation has a budget of its own
+		res, e := interp.EvalString(context.Background(), "(loop* [i 0] (if (= i 100) i (recur (+ i 1))))")
+		if e != nil || res != 100 {
+			t.Errorf("%s: after the budget ran out, got %v, %v", ev.name, res, e)
+		}
+	}
+}
+
+func TestMaxAlloc(t *testing.T) {
+	src := "(loop* [v []] (recur (conj v (str (count v)))))"
+	for _, ev := range evaluators {
+		if _, e := eval_with(t, Options{Evaluator: ev.ev, MaxAlloc: 1 << 20}, src); ErrorCategory(e) != "limit" {
+			t.Errorf("%s: got %v, want a limit error", ev.name, e)
+		}
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	for _, ev := range evaluators {
+		interp, e := New(Options{Evaluator: ev.ev})
+		if e != nil {
+			t.Fatal(e)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		if _, e := interp.EvalString(ctx, spin); ErrorCategory(e) != "cancelled" {
+			t.Errorf("%s: got %v, want a cancelled error", ev.name, e)
+		}
+		// a builtin waiting, here on a future that never finishes,
+		// stops too
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, e = interp.EvalString(ctx, "@(future "+spin+")")
+		cancel()
+		if ErrorCategory(e) != "timeout" {
+			t.Errorf("%s: got %v, want a timeout error", ev.name, e)
+		}
+		// a handler can clean up, but not carry on
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, e = interp.EvalString(ctx, "(try* "+spin+" (catch* e "+spin+"))")
+		cancel()
+		if ErrorCategory(e) != "timeout" {
+			t.Errorf("%s: after catching, got %v, want a timeout error", ev.name, e)
+		}
+	}
+}
+
+// Evaluations running at once in the same interpreter each stop at
+// their own deadline
+func TestConcurrentDeadlines(t *testing.T) {
+	for _, ev := range evaluators {
+		interp, e := New(Options{Evaluator: ev.ev})
+		if e != nil {
+			t.Fatal(e)
+		}
+		run := func(timeout time.Duration) <-chan time.Duration {
+			done := make(chan time.Duration)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				start := time.Now()
+				if _, e := interp.EvalString(ctx, spin); ErrorCategory(e) != "timeout" {
+					t.Errorf("%s: got %v, want a timeout error", ev.name, e)
+				}
+				done <- time.Since(start)
+			}()
+			return done
+		}
+		long := run(time.Second)
+		time.Sleep(10 * time.Millisecond)
+		short := run(100 * time.Millisecond)
+		if d := <-short; d > 500*time.Millisecond {
+			t.Errorf("%s: a 100ms deadline took %v", ev.name, d)
+		}
+		if d := <-long; d < 900*time.Millisecond {
+			t.Errorf("%s: a 1s deadline stopped after %v", ev.name, d)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package mal
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+import (
+	. "env"
+	"printer"
+	. "types"
+)
+
+// Marshal and Unmarshal convert between Go values and mal data in the
+// manner of encoding/json. Struct fields become hash-map entries keyed
+// by keywords named as mal names are, so ListenAddr is :listen-addr.
+// A mal struct tag changes that:
+//
+//	Port int    `mal:"port-number"`   // :port-number
+//	Name string `mal:"name,string"`   // "name", a string key
+//	Note string `mal:",omitempty"`    // left out when empty
+//	Skip int    `mal:"-"`             // never converted
+//
+// time.Time values are RFC 3339 strings, which Unmarshal also accepts
+// as milliseconds since the epoch. Fields of type interface{} hold mal
+// values as they are. Types can convert themselves by implementing
+// Marshaler and Unmarshaler.
+
+type Marshaler interface {
+	MarshalMal() (MalType, error)
+}
+
+type Unmarshaler interface {
+	UnmarshalMal(MalType) error
+}
+
+var (
+	marshaler_type   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshaler_type = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	time_type        = reflect.TypeOf(time.Time{})
+	types_pkg        = reflect.TypeOf(List{}).PkgPath()
+	env_pkg          = reflect.TypeOf((*Env)(nil)).Elem().PkgPath()
+)
+
+// Values of the types and env packages are mal values already
+func is_mal_type(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.PkgPath() == types_pkg || t.PkgPath() == env_pkg
+}
+
+type field struct {
+	index     []int
+	name      string
+	key       string // the hash-map key, a keyword unless tagged string
+	omitempty bool
+}
+
+// The fields of a struct type that are converted, including those of
+// embedded structs
+func struct_fields(t reflect.Type) []field {
+	fields := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("mal")
+		if tag == "-" {
+			continue
+		}
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct && tag == "" {
+			for _, f := range struct_fields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		opts := strings.Split(tag, ",")
+		f := field{index: []int{i}, name: opts[0]}
+		if f.name == "" {
+			f.name = mal_name(sf.Name)
+		}
+		kw, _ := NewKeyword(f.name)
+		f.key = kw.(string)
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "omitempty":
+				f.omitempty = true
+			case "string":
+				f.key = f.name
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func is_empty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// Convert a Go value to mal data
+func Marshal(v interface{}) (MalType, error) {
+	return marshal(reflect.ValueOf(v), visits{})
+}
+
+// A pointer, map or slice being marshaled. One that is reached again
+// while it is being marshaled is part of a cycle, which has no mal
+// equivalent.
+type visit struct {
+	ptr uintptr
+	t   reflect.Type
+	n   int // the length of a slice
+}
+
+type visits map[visit]bool
+
+// Mark v as being marshaled, returning a function that unmarks it, or
+// an error if it already is
+func (vs visits) enter(v reflect.Value, n int) (func(), error) {
+	key := visit{v.Pointer(), v.Type(), n}
+	if vs[key] {
+		return nil, TypeError("cannot marshal a cyclic value of type " + v.Type().String())
+	}
+	vs[key] = true
+	return func() { delete(vs, key) }, nil
+}
+
+func marshal(v reflect.Value, seen visits) (MalType, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	t := v.Type()
+	if t.Implements(marshaler_type) {
+		if t.Kind() == reflect.Ptr && v.IsNil() {
+			return nil, nil
+		}
+		return v.Interface().(Marshaler).MarshalMal()
+	}
+	if v.CanAddr() && reflect.PtrTo(t).Implements(marshaler_type) {
+		return v.Addr().Interface().(Marshaler).MarshalMal()
+	}
+	if t == time_type {
+		return v.Interface().(time.Time).Format(time.RFC3339Nano), nil
+	}
+	if is_mal_type(t) {
+		return v.Interface(), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return from_go(v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Kind() == reflect.Ptr {
+			leave, e := seen.enter(v, 0)
+			if e != nil {
+				return nil, e
+			}
+			defer leave()
+		}
+		return marshal(v.Elem(), seen)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice {
+			if v.IsNil() {
+				return nil, nil
+			}
+			if t.Elem().Kind() == reflect.Uint8 {
+				return string(v.Bytes()), nil
+			}
+			leave, e := seen.enter(v, v.Len())
+			if e != nil {
+				return nil, e
+			}
+			defer leave()
+		}
+		lst := make([]MalType, v.Len())
+		for i := range lst {
+			item, e := marshal(v.Index(i), seen)
+			if e != nil {
+				return nil, e
+			}
+			lst[i] = item
+		}
+		return Vector{lst, nil}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			break
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		leave, e := seen.enter(v, 0)
+		if e != nil {
+			return nil, e
+		}
+		defer leave()
+		hm := HashMap{map[string]MalType{}, nil}
+		iter := v.MapRange()
+		for iter.Next() {
+			item, e := marshal(iter.Value(), seen)
+			if e != nil {
+				return nil, e
+			}
+			hm.Val[iter.Key().String()] = item
+		}
+		return hm, nil
+	case reflect.Struct:
+		hm := HashMap{map[string]MalType{}, nil}
+		for _, f := range struct_fields(t) {
+			fv := v.FieldByIndex(f.index)
+			if f.omitempty && is_empty(fv) {
+				continue
+			}
+			item, e := marshal(fv, seen)
+			if e != nil {
+				return nil, e
+			}
+			hm.Val[f.key] = item
+		}
+		return hm, nil
+	}
+	return nil, TypeError("cannot marshal a value of type " + t.String())
+}
+
+// Store mal data in the Go value ptr points to. Hash-map entries with
+// no matching field are ignored, and nil leaves a value at its zero.
+func Unmarshal(val MalType, ptr interface{}) error {
+	v := reflect.ValueOf(ptr)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return TypeError("Unmarshal requires a non-nil pointer")
+	}
+	return unmarshal(val, v.Elem(), v.Type().Elem().String())
+}
+
+func unmarshal_error(val MalType, path string, t reflect.Type) error {
+	return TypeError(fmt.Sprintf("cannot unmarshal %s into %s of type %s",
+		printer.Pr_str(val, true), path, t))
+}
+
+// Look a struct field up by its keyword or by its name as a string
+func field_value(hm HashMap, f field) (MalType, bool) {
+	if val, ok := hm.Val[f.key]; ok {
+		return val, true
+	}
+	val, ok := hm.Val[f.name]
+	return val, ok
+}
+
+func unmarshal(val MalType, v reflect.Value, path string) error {
+	t := v.Type()
+	if reflect.PtrTo(t).Implements(unmarshaler_type) {
+		return v.Addr().Interface().(Unmarshaler).UnmarshalMal(val)
+	}
+	if t.Kind() == reflect.Ptr {
+		if val == nil {
+			v.Set(reflect.Zero(t))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return unmarshal(val, v.Elem(), path)
+	}
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		if val == nil {
+			v.Set(reflect.Zero(t))
+		} else {
+			v.Set(reflect.ValueOf(val))
+		}
+		return nil
+	}
+	if val == nil {
+		v.Set(reflect.Zero(t))
+		return nil
+	}
+	if t == time_type {
+		var tm time.Time
+		var e error
+		switch tv := val.(type) {
+		case string:
+			tm, e = time.Parse(time.RFC3339Nano, tv)
+		case int:
+			tm = time.UnixMilli(int64(tv))
+		default:
+			return unmarshal_error(val, path, t)
+		}
+		if e != nil {
+			return TypeError(path + ": " + e.Error())
+		}
+		v.Set(reflect.ValueOf(tm))
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if is_mal_type(t) {
+			break
+		}
+		hm, ok := val.(HashMap)
+		if !ok {
+			return unmarshal_error(val, path, t)
+		}
+		for _, f := range struct_fields(t) {
+			item, ok := field_value(hm, f)
+			if !ok {
+				continue
+			}
+			fv := v.FieldByIndex(f.index)
+			if e := unmarshal(item, fv, path+"."+t.FieldByIndex(f.index).Name); e != nil {
+				return e
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if _, ok := val.(string); ok {
+			break
+		}
+		slc, e := GetSlice(val)
+		if e != nil {
+			return unmarshal_error(val, path, t)
+		}
+		res := reflect.MakeSlice(t, len(slc), len(slc))
+		for i, item := range slc {
+			if e := unmarshal(item, res.Index(i), fmt.Sprintf("%s[%d]", path, i)); e != nil {
+				return e
+			}
+		}
+		v.Set(res)
+		return nil
+	case reflect.Array:
+		slc, e := GetSlice(val)
+		if e != nil || len(slc) > v.Len() {
+			return unmarshal_error(val, path, t)
+		}
+		v.Set(reflect.Zero(t))
+		for i, item := range slc {
+			if e := unmarshal(item, v.Index(i), fmt.Sprintf("%s[%d]", path, i)); e != nil {
+				return e
+			}
+		}
+		return nil
+	case reflect.Map:
+		hm, ok := val.(HashMap)
+		if !ok || t.Key().Kind() != reflect.String {
+			return unmarshal_error(val, path, t)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(t, len(hm.Val)))
+		}
+		for k, item := range hm.Val {
+			ks, _ := go_string(k)
+			iv := reflect.New(t.Elem()).Elem()
+			if e := unmarshal(item, iv, path+"["+ks+"]"); e != nil {
+				return e
+			}
+			v.SetMapIndex(reflect.ValueOf(ks).Convert(t.Key()), iv)
+		}
+		return nil
+	}
+	cv, e := to_go(val, t)
+	if e != nil {
+		return unmarshal_error(val, path, t)
+	}
+	v.Set(cv)
+	return nil
+}
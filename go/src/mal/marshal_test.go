@@ -0,0 +1,155 @@
+package mal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"printer"
+	. "types"
+)
+
+type upper string
+
+func (u upper) MarshalMal() (MalType, error) {
+	return strings.ToUpper(string(u)), nil
+}
+
+func (u *upper) UnmarshalMal(val MalType) error {
+	s, _ := val.(string)
+	*u = upper(strings.ToLower(s))
+	return nil
+}
+
+type endpoint struct {
+	Host string
+	Port int `mal:"port-number"`
+}
+
+type config struct {
+	ListenAddr string
+	Name       string            `mal:"name,string"`
+	Note       string            `mal:",omitempty"`
+	Skip       int               `mal:"-"`
+	Ratio      float64           `mal:"ratio"`
+	Tags       []string          `mal:"tags"`
+	Limits     map[string]int    `mal:"limits"`
+	Primary    *endpoint         `mal:"primary"`
+	Backups    []endpoint        `mal:"backups"`
+	Started    time.Time         `mal:"started"`
+	Label      upper             `mal:"label"`
+	Extra      interface{}       `mal:"extra"`
+	Headers    map[string]string `mal:"headers,omitempty"`
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	in := config{
+		ListenAddr: ":8080",
+		Name:       "svc",
+		Skip:       3,
+		Ratio:      0.5,
+		Tags:       []string{"a", "b"},
+		Limits:     map[string]int{"cpu": 2},
+		Primary:    &endpoint{"db", 5432},
+		Backups:    []endpoint{{"db2", 5433}},
+		Started:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Label:      "blue",
+		Extra:      Vector{[]MalType{1, "ʞk"}, nil},
+	}
+	val, e := Marshal(in)
+	if e != nil {
+		t.Fatal(e)
+	}
+	hm := val.(HashMap)
+	for key, want := range map[string]string{
+		"ʞlisten-addr": `":8080"`,
+		"name":         `"svc"`,
+		"ʞport-number": "",
+		"ʞstarted":     `"2024-01-02T03:04:05Z"`,
+		"ʞlabel":       `"BLUE"`,
+		"ʞtags":        `["a" "b"]`,
+	} {
+		got, ok := hm.Val[key]
+		if want == "" {
+			if ok {
+				t.Errorf("%s: should not be marshaled", key)
+			}
+			continue
+		}
+		if printer.Pr_str(got, true) != want {
+			t.Errorf("%s: got %s, want %s", key, printer.Pr_str(got, true), want)
+		}
+	}
+	primary := HashMap{map[string]MalType{"ʞhost": "db", "ʞport-number": 5432}, nil}
+	if !Equal_Q(hm.Val["ʞprimary"], primary) {
+		t.Errorf("primary: got %s", printer.Pr_str(hm.Val["ʞprimary"], true))
+	}
+	for _, key := range []string{"ʞnote", "ʞskip", "ʞheaders"} {
+		if _, ok := hm.Val[key]; ok {
+			t.Errorf("%s: should be left out", key)
+		}
+	}
+	var out config
+	if e := Unmarshal(val, &out); e != nil {
+		t.Fatal(e)
+	}
+	in.Skip = 0
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip:\ngot  %#v\nwant %#v", out, in)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var cfg config
+	for _, c := range []struct {
+		val MalType
+		ptr interface{}
+		msg string
+	}{
+		{HashMap{map[string]MalType{"ʞtags": 1}, nil}, &cfg,
+			"cannot unmarshal 1 into mal.config.Tags of type []string"},
+		{HashMap{map[string]MalType{"ʞprimary": HashMap{map[string]MalType{"ʞport-number": "x"}, nil}}, nil}, &cfg,
+			`cannot unmarshal "x" into mal.config.Primary.Port of type int`},
+		{1, cfg, "Unmarshal requires a non-nil pointer"},
+	} {
+		if e := Unmarshal(c.val, c.ptr); e == nil || e.Error() != c.msg {
+			t.Errorf("got %v, want %q", e, c.msg)
+		}
+	}
+}
+
+type node struct {
+	Name string
+	Next *node
+}
+
+func TestMarshalCycles(t *testing.T) {
+	loop := &node{Name: "a"}
+	loop.Next = &node{"b", loop}
+	if _, e := Marshal(loop); e == nil || e.Error() != "cannot marshal a cyclic value of type *mal.node" {
+		t.Errorf("pointer cycle: got %v", e)
+	}
+	m := map[string]interface{}{}
+	m["self"] = m
+	if _, e := Marshal(m); e == nil {
+		t.Error("map cycle: no error")
+	}
+	s := []interface{}{nil}
+	s[0] = s
+	if _, e := Marshal(s); e == nil {
+		t.Error("slice cycle: no error")
+	}
+	// the same value twice is not a cycle
+	shared := &node{Name: "shared"}
+	val, e := Marshal([]*node{shared, shared})
+	if e != nil {
+		t.Fatal(e)
+	}
+	item := HashMap{map[string]MalType{"ʞname": "shared", "ʞnext": nil}, nil}
+	if !Equal_Q(val, Vector{[]MalType{item, item}, nil}) {
+		t.Errorf("shared pointer: got %s", printer.Pr_str(val, true))
+	}
+}
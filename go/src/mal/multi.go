@@ -0,0 +1,133 @@
+package mal
+
+import (
+	. "env"
+	. "types"
+)
+
+// Multimethods and the hierarchy they dispatch in. Each interpreter
+// has one hierarchy, which derive adds to:
+//
+//	(derive :square :rect)
+//	(defmulti area :shape)
+//	(defmethod area :rect [r] (* (:w r) (:h r)))
+//	(area {:shape :square :w 2 :h 2})   ; 4
+//
+// defmulti and defmethod are macros over multi-fn and add-method.
+// parents and ancestors return lists, there being no sets.
+
+func (interp *Interpreter) multi_fn(a []MalType) (MalType, error) {
+	if len(a) < 2 || len(a)%2 != 0 {
+		return nil, ArityError("multi-fn requires a name, a dispatch function and options")
+	}
+	name, ok := a[0].(Symbol)
+	if !ok {
+		return nil, TypeError("multi-fn requires a symbol name")
+	}
+	default_val, _ := NewKeyword("default")
+	for i := 2; i < len(a); i += 2 {
+		if !is_keyword(a[i], "default") {
+			return nil, TypeError("unknown multi-fn option " + Print(a[i]))
+		}
+		default_val = a[i+1]
+	}
+	return NewMultiFn(name.Val, a[1], default_val, interp.hierarchy), nil
+}
+
+func multi_arg(name string, a []MalType) (*MultiFn, error) {
+	mf, ok := a[0].(*MultiFn)
+	if !ok {
+		return nil, TypeError(name + " requires a multimethod")
+	}
+	return mf, nil
+}
+
+func add_method(a []MalType) (MalType, error) {
+	mf, e := multi_arg("add-method", a)
+	if e != nil {
+		return nil, e
+	}
+	mf.AddMethod(a[1], a[2])
+	return mf, nil
+}
+
+func remove_method(a []MalType) (MalType, error) {
+	mf, e := multi_arg("remove-method", a)
+	if e != nil {
+		return nil, e
+	}
+	mf.RemoveMethod(a[1])
+	return mf, nil
+}
+
+func get_method(a []MalType) (MalType, error) {
+	mf, e := multi_arg("get-method", a)
+	if e != nil {
+		return nil, e
+	}
+	return mf.GetMethod(a[1]), nil
+}
+
+// (methods f) is a list of [dispatch-value method] pairs, as dispatch
+// values need not be map keys
+func methods(a []MalType) (MalType, error) {
+	mf, e := multi_arg("methods", a)
+	if e != nil {
+		return nil, e
+	}
+	lst := []MalType{}
+	for _, m := range mf.Methods() {
+		lst = append(lst, Vector{[]MalType{m[0], m[1]}, nil})
+	}
+	return List{lst, nil}, nil
+}
+
+func prefer_method(a []MalType) (MalType, error) {
+	mf, e := multi_arg("prefer-method", a)
+	if e != nil {
+		return nil, e
+	}
+	if e := mf.PreferMethod(a[1], a[2]); e != nil {
+		return nil, e
+	}
+	return mf, nil
+}
+
+func (interp *Interpreter) derive(a []MalType) (MalType, error) {
+	if e := interp.hierarchy.Derive(a[0], a[1]); e != nil {
+		return nil, e
+	}
+	return nil, nil
+}
+
+func (interp *Interpreter) isa_Q(a []MalType) (MalType, error) {
+	return interp.hierarchy.Isa(a[0], a[1]), nil
+}
+
+func tag_list(tags []MalType) MalType {
+	if len(tags) == 0 {
+		return nil
+	}
+	return List{tags, nil}
+}
+
+func (interp *Interpreter) parents(a []MalType) (MalType, error) {
+	return tag_list(interp.hierarchy.Parents(a[0])), nil
+}
+
+func (interp *Interpreter) ancestors(a []MalType) (MalType, error) {
+	return tag_list(interp.hierarchy.Ancestors(a[0])), nil
+}
+
+func (interp *Interpreter) init_multi(core_ns *Namespace) {
+	core_ns.Set(Symbol{"multi-fn"}, Func{interp.multi_fn, nil})
+	core_ns.Set(Symbol{"add-method"}, Func{add_method, nil})
+	core_ns.Set(Symbol{"remove-method"}, Func{remove_method, nil})
+	core_ns.Set(Symbol{"get-method"}, Func{get_method, nil})
+	core_ns.Set(Symbol{"methods"}, Func{methods, nil})
+	core_ns.Set(Symbol{"prefer-method"}, Func{prefer_method, nil})
+	core_ns.Set(Symbol{"derive"}, Func{interp.derive, nil})
+	core_ns.Set(Symbol{"isa?"}, Func{interp.isa_Q, nil})
+	core_ns.Set(Symbol{"parents"}, Func{interp.parents, nil})
+	core_ns.Set(Symbol{"ancestors"}, Func{interp.ancestors, nil})
+}
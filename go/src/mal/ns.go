@@ -0,0 +1,219 @@
+package mal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+import (
+	. "env"
+	"printer"
+	"reader"
+	. "types"
+)
+
+func (interp *Interpreter) current_ns() *Namespace {
+	ns, _ := interp.namespaces.Core().Get(Symbol{"*ns*"})
+	return ns.(*Namespace)
+}
+
+func (interp *Interpreter) set_current_ns(ns *Namespace) {
+	interp.namespaces.Core().Set(Symbol{"*ns*"}, ns)
+}
+
+// Evaluate each form in a file in turn, in whatever namespace is
+// current when it is reached, and restore the current namespace after.
+func (interp *Interpreter) load_file(ctx context.Context, a []MalType) (MalType, error) {
+	path, ok := a[0].(string)
+	if !ok {
+		return nil, TypeError("load-file requires a file name")
+	}
+	b, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	forms, lines, e := reader.Read_all_lines(string(b))
+	if e != nil {
+		return nil, e
+	}
+	for first, line := range lines {
+		if sym, ok := (*first).(Symbol); ok && sym.Val == "fn*" {
+			interp.locations.Store(first, path+":"+strconv.Itoa(line))
+		}
+	}
+	defer interp.set_current_ns(interp.current_ns())
+	var res MalType
+	for _, form := range forms {
+		if res, e = interp.eval(ctx, form, interp.current_ns()); e != nil {
+			return nil, e
+		}
+	}
+	return res, nil
+}
+
+func (interp *Interpreter) in_ns(a []MalType) (MalType, error) {
+	sym, ok := a[0].(Symbol)
+	if !ok {
+		return nil, TypeError("in-ns requires a symbol")
+	}
+	ns := interp.namespaces.Intern(sym.Val)
+	interp.set_current_ns(ns)
+	return ns, nil
+}
+
+// Load a namespace that is not defined yet from a file found on
+// *load-path*, so that a.b-c is read from a/b_c.mal.
+func (interp *Interpreter) load_ns(ctx context.Context, name string) (*Namespace, error) {
+	if !interp.allowed("io-read") {
+		return nil, NotFoundError("namespace " + name + " not found")
+	}
+	rel := strings.Replace(strings.Replace(name, ".", "/", -1), "-", "_", -1) + ".mal"
+	dirs_mt, _ := interp.current_ns().Get(Symbol{"*load-path*"})
+	dirs, _ := GetSlice(dirs_mt)
+	for _, dir := range dirs {
+		path := filepath.Join(fmt.Sprint(dir), rel)
+		if _, e := os.Stat(path); e != nil {
+			continue
+		}
+		if _, e := interp.load_file(ctx, []MalType{path}); e != nil {
+			return nil, e
+		}
+		if ns := interp.namespaces.Find(name); ns != nil {
+			return ns, nil
+		}
+		return nil, NotFoundError(path + " did not define namespace " + name)
+	}
+	return nil, NotFoundError("namespace " + name + " not found")
+}
+
+// (require 'a.b '[c.d :as d :refer [f g]] '[e.f :refer :all])
+func (interp *Interpreter) require(ctx context.Context, a []MalType) (MalType, error) {
+	for _, spec := range a {
+		var opts []MalType
+		if Sequential_Q(spec) {
+			opts, _ = GetSlice(spec)
+			if len(opts) == 0 {
+				return nil, errors.New("require: empty spec")
+			}
+			spec, opts = opts[0], opts[1:]
+		}
+		sym, ok := spec.(Symbol)
+		if !ok || len(opts)%2 == 1 {
+			return nil, errors.New("require: invalid spec")
+		}
+		target := interp.namespaces.Find(sym.Val)
+		if target == nil {
+			var e error
+			if target, e = interp.load_ns(ctx, sym.Val); e != nil {
+				return nil, e
+			}
+		}
+		ns := interp.current_ns()
+		for i := 0; i < len(opts); i += 2 {
+			switch {
+			case Equal_Q(opts[i], "\u029eas") && Symbol_Q(opts[i+1]):
+				ns.Alias(opts[i+1].(Symbol).Val, target)
+			case Equal_Q(opts[i], "\u029erefer") && Equal_Q(opts[i+1], "\u029eall"):
+				ns.ReferAll(target)
+			case Equal_Q(opts[i], "\u029erefer") && Sequential_Q(opts[i+1]):
+				names, _ := GetSlice(opts[i+1])
+				for _, n := range names {
+					if !Symbol_Q(n) {
+						return nil, errors.New("require: :refer takes symbols")
+					}
+					if e := ns.Refer(n.(Symbol).Val, target); e != nil {
+						return nil, e
+					}
+				}
+			default:
+				return nil, errors.New("require: unknown option " + printer.Pr_str(opts[i], true))
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Environment introspection. Each of these takes an optional trailing
+// environment and otherwise works on the current namespace.
+func (interp *Interpreter) env_arg(a []MalType, n int, fn string) (EnvType, error) {
+	if len(a) <= n {
+		return interp.current_ns(), nil
+	}
+	env, ok := a[n].(EnvType)
+	if !ok {
+		return nil, TypeError(fn + " requires an environment")
+	}
+	return env, nil
+}
+
+func (interp *Interpreter) sym_env_args(a []MalType, fn string) (Symbol, EnvType, error) {
+	if len(a) < 1 || len(a) > 2 || !Symbol_Q(a[0]) {
+		return Symbol{}, nil, TypeError(fn + " requires a symbol and an optional environment")
+	}
+	env, e := interp.env_arg(a, 1, fn)
+	return a[0].(Symbol), env, e
+}
+
+func (interp *Interpreter) resolve(a []MalType) (MalType, error) {
+	sym, env, e := interp.sym_env_args(a, "resolve")
+	if e != nil {
+		return nil, e
+	}
+	if env.Find(sym) == nil {
+		return nil, nil
+	}
+	return env.Get(sym)
+}
+
+func (interp *Interpreter) bound_Q(a []MalType) (MalType, error) {
+	sym, env, e := interp.sym_env_args(a, "bound?")
+	if e != nil {
+		return nil, e
+	}
+	return env.Find(sym) != nil, nil
+}
+
+func (interp *Interpreter) undef_BANG(a []MalType) (MalType, error) {
+	sym, env, e := interp.sym_env_args(a, "undef!")
+	if e != nil {
+		return nil, e
+	}
+	return env.Remove(sym), nil
+}
+
+func (interp *Interpreter) env_keys(a []MalType) (MalType, error) {
+	env, e := interp.env_arg(a, 0, "env-keys")
+	if e != nil {
+		return nil, e
+	}
+	keys := env.Keys()
+	lst := make([]MalType, len(keys))
+	for i, k := range keys {
+		lst[i] = k
+	}
+	return List{lst, nil}, nil
+}
+
+func (interp *Interpreter) ns_publics(a []MalType) (MalType, error) {
+	var ns *Namespace
+	switch arg := a[0].(type) {
+	case *Namespace:
+		ns = arg
+	case Symbol:
+		ns = interp.namespaces.Find(arg.Val)
+	}
+	if ns == nil {
+		return nil, TypeError("ns-publics requires a namespace")
+	}
+	hm := HashMap{map[string]MalType{}, nil}
+	for _, k := range ns.Keys() {
+		hm.Val[k.Val], _ = ns.Get(k)
+	}
+	return hm, nil
+}
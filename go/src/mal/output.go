@@ -0,0 +1,54 @@
+package mal
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+import (
+	"core"
+	. "env"
+	. "types"
+)
+
+// prn and println write to *out*, a dynamic var whose root value is a
+// handle on standard output. It can be bound to a handle on any Go
+// io.Writer, or to a function that is called with each string written.
+
+// A function *out* is bound to, called in the context of the evaluation
+// writing
+type fn_writer struct {
+	interp *Interpreter
+	ctx    context.Context
+	fn     MalType
+}
+
+func (w fn_writer) Write(p []byte) (int, error) {
+	if _, e := w.interp.apply(w.ctx, w.fn, []MalType{string(p)}); e != nil {
+		return 0, e
+	}
+	return len(p), nil
+}
+
+func (interp *Interpreter) out_writer(ctx context.Context) (io.Writer, error) {
+	switch out := interp.out.Get(ctx).(type) {
+	case Handle:
+		if w, ok := out.Val.(io.Writer); ok {
+			return w, nil
+		}
+	case MalFunc, Func:
+		return fn_writer{interp, ctx, out}, nil
+	}
+	return nil, TypeError("*out* must be a Go writer or a function")
+}
+
+func (interp *Interpreter) init_output(core_ns *Namespace) {
+	interp.out = NewVar(core_ns.Name+"/*out*", Handle{os.Stdout})
+	core_ns.Set(Symbol{"*out*"}, interp.out)
+	interp.trace_macros = NewVar(core_ns.Name+"/*trace-macros*", false)
+	core_ns.Set(Symbol{"*trace-macros*"}, interp.trace_macros)
+	for k, v := range core.Output(interp.out_writer) {
+		core_ns.Set(Symbol{k}, Func{v.(func([]MalType) (MalType, error)), nil})
+	}
+}
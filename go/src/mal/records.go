@@ -0,0 +1,207 @@
+package mal
+
+import (
+	. "env"
+	. "types"
+)
+
+// Records and protocols:
+//
+//	(defrecord Point [x y])
+//	(defprotocol Shape (area [s]))
+//	(extend-type Point Shape (area [p] (* (get p :x) (get p :y))))
+//	(extend-protocol Shape
+//	  types.List (area [l] (count l))
+//	  int (area [n] n))
+//	(area (->Point 2 3))   ; 6
+//
+// defrecord also defines map->Point, and takes protocol implementations
+// like extend-type's in which the fields are bound by name. Types are
+// named by the symbol their record type is defined as, or by the names
+// type returns for the built-in ones.
+
+// The types a protocol can be extended to besides records, by name
+var builtin_types = map[string]bool{}
+
+func init() {
+	for _, val := range []MalType{nil, true, 0, "", "\u029ek", Symbol{},
+		List{}, Vector{}, HashMap{}, MalFunc{}, Func{}, &Atom{},
+		&MultiFn{}, &Var{}, &Future{}, &Chan{}, Handle{}, ExInfo{}} {
+		builtin_types[TypeName(val)] = true
+	}
+}
+
+// (record-type 'Point '[x y])
+func (interp *Interpreter) record_type(a []MalType) (MalType, error) {
+	name, ok := a[0].(Symbol)
+	if !ok {
+		return nil, TypeError("record-type requires a symbol name")
+	}
+	syms, e := GetSlice(a[1])
+	if e != nil {
+		return nil, TypeError("record-type requires a vector of fields")
+	}
+	fields := make([]string, len(syms))
+	for i, sym := range syms {
+		if !Symbol_Q(sym) {
+			return nil, TypeError("record-type requires a vector of fields")
+		}
+		kw, _ := NewKeyword(sym.(Symbol).Val)
+		fields[i] = kw.(string)
+	}
+	return &RecordType{interp.current_ns().Name + "." + name.Val, fields}, nil
+}
+
+// (new-record Point 1 2) makes a record from its fields in order
+func new_record(a []MalType) (MalType, error) {
+	rt, ok := a[0].(*RecordType)
+	if !ok {
+		return nil, TypeError("new-record requires a record type")
+	}
+	if len(a)-1 != len(rt.Fields) {
+		return nil, ArityError("new-record: wrong number of fields for " + rt.Name)
+	}
+	vals := make(map[string]MalType, len(rt.Fields))
+	for i, f := range rt.Fields {
+		vals[f] = a[i+1]
+	}
+	return Record{rt, vals, nil}, nil
+}
+
+// (map->record Point {:x 1 :y 2}), fields missing from the map nil
+func map_to_record(a []MalType) (MalType, error) {
+	rt, ok := a[0].(*RecordType)
+	if !ok {
+		return nil, TypeError("map->record requires a record type")
+	}
+	entries, ok := MapEntries(a[1])
+	if !ok {
+		return nil, TypeError("map->record requires a map")
+	}
+	vals := make(map[string]MalType, len(entries))
+	for _, f := range rt.Fields {
+		vals[f] = nil
+	}
+	for k, v := range entries {
+		vals[k] = v
+	}
+	return Record{rt, vals, nil}, nil
+}
+
+// (protocol 'Shape '(area perimeter))
+func (interp *Interpreter) protocol(a []MalType) (MalType, error) {
+	name, ok := a[0].(Symbol)
+	if !ok {
+		return nil, TypeError("protocol requires a symbol name")
+	}
+	syms, e := GetSlice(a[1])
+	if e != nil {
+		return nil, TypeError("protocol requires a list of method names")
+	}
+	methods := make([]string, len(syms))
+	for i, sym := range syms {
+		if !Symbol_Q(sym) {
+			return nil, TypeError("protocol requires a list of method names")
+		}
+		methods[i] = sym.(Symbol).Val
+	}
+	return NewProtocol(interp.current_ns().Name+"."+name.Val, methods, interp.hierarchy), nil
+}
+
+// (protocol-fn Shape 'area) is the function calling the method
+func protocol_fn(a []MalType) (MalType, error) {
+	p, ok := a[0].(*Protocol)
+	if !ok {
+		return nil, TypeError("protocol-fn requires a protocol")
+	}
+	sym, ok := a[1].(Symbol)
+	if !ok {
+		return nil, TypeError("protocol-fn requires a method name")
+	}
+	mf, ok := p.Fns[sym.Val]
+	if !ok {
+		return nil, NotFoundError("protocol " + p.Name + " has no method " + sym.Val)
+	}
+	return mf, nil
+}
+
+// The name of the type a symbol or record type designates
+func (interp *Interpreter) type_name(t MalType) (string, error) {
+	if t == nil {
+		// nil reads as itself rather than a symbol
+		return "nil", nil
+	}
+	if sym, ok := t.(Symbol); ok {
+		val, e := interp.resolve([]MalType{sym})
+		if e != nil {
+			return "", e
+		}
+		if val == nil && builtin_types[sym.Val] {
+			return sym.Val, nil
+		}
+		if !is_record_type(val) {
+			return "", NotFoundError("unknown type " + sym.Val)
+		}
+		t = val
+	}
+	if rt, ok := t.(*RecordType); ok {
+		return rt.Name, nil
+	}
+	return "", NotFoundError("unknown type " + Print(t))
+}
+
+func is_record_type(val MalType) bool {
+	_, ok := val.(*RecordType)
+	return ok
+}
+
+// (extend 'Point Shape ['area f] ['perimeter g] Other ['m h]) gives a
+// type implementations of protocols' methods. Types and protocols come
+// in any order, extend-protocol passing the protocol first, and each
+// [name fn] is for the last type and protocol before it.
+func (interp *Interpreter) extend(a []MalType) (MalType, error) {
+	var p *Protocol
+	t := ""
+	for _, arg := range a {
+		switch arg := arg.(type) {
+		case *Protocol:
+			p = arg
+		case Vector:
+			if p == nil || t == "" {
+				return nil, TypeError("extend requires a type and a protocol before methods")
+			}
+			if len(arg.Val) != 2 || !Symbol_Q(arg.Val[0]) {
+				return nil, TypeError("extend requires methods as [name fn]")
+			}
+			if e := p.Extend(t, arg.Val[0].(Symbol).Val, arg.Val[1]); e != nil {
+				return nil, e
+			}
+		default:
+			name, e := interp.type_name(arg)
+			if e != nil {
+				return nil, e
+			}
+			t = name
+		}
+	}
+	return nil, nil
+}
+
+// (satisfies? Shape x)
+func satisfies_Q(a []MalType) (MalType, error) {
+	p, ok := a[0].(*Protocol)
+	if !ok {
+		return nil, TypeError("satisfies? requires a protocol")
+	}
+	return p.Extends(TypeName(a[1])), nil
+}
+
+func (interp *Interpreter) init_records(core_ns *Namespace) {
+	core_ns.Set(Symbol{"record-type"}, Func{interp.record_type, nil})
+	core_ns.Set(Symbol{"new-record"}, Func{new_record, nil})
+	core_ns.Set(Symbol{"map->record"}, Func{map_to_record, nil})
+	core_ns.Set(Symbol{"protocol"}, Func{interp.protocol, nil})
+	core_ns.Set(Symbol{"protocol-fn"}, Func{protocol_fn, nil})
+	core_ns.Set(Symbol{"extend"}, Func{interp.extend, nil})
+	core_ns.Set(Symbol{"satisfies?"}, Func{satisfies_Q, nil})
+}
@@ -0,0 +1,123 @@
+package mal
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+import (
+	. "types"
+)
+
+var error_type = reflect.TypeOf((*error)(nil)).Elem()
+
+// Wrap an ordinary Go function as a mal function. Arguments are
+// converted to the parameter types, and results back to mal values:
+// no result gives nil, one is returned as it is and more than one as a
+// vector. A final error result is raised when it is not nil, as are
+// panics in the function.
+func WrapFunc(name string, fn interface{}) (Func, error) {
+	switch f := fn.(type) {
+	case Func:
+		return f, nil
+	case func([]MalType) (MalType, error):
+		return Func{f, nil}, nil
+	}
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		return Func{}, TypeError(name + " is not a function")
+	}
+	return wrap_func(name, fv), nil
+}
+
+func wrap_func(name string, fv reflect.Value) Func {
+	ft := fv.Type()
+	nin, nout := ft.NumIn(), ft.NumOut()
+	variadic := ft.IsVariadic()
+	has_err := nout > 0 && ft.Out(nout-1) == error_type
+	nreq := nin
+	if variadic {
+		nreq--
+	}
+	return Func{func(a []MalType) (res MalType, err error) {
+		if len(a) < nreq || (!variadic && len(a) > nin) {
+			expected := strconv.Itoa(nreq)
+			if variadic {
+				expected = "at least " + expected
+			}
+			return nil, ArityError(fmt.Sprintf("%s: wrong number of arguments (got %d, expected %s)",
+				name, len(a), expected))
+		}
+		args := make([]reflect.Value, len(a))
+		for i, arg := range a {
+			var t reflect.Type
+			if variadic && i >= nreq {
+				t = ft.In(nreq).Elem()
+			} else {
+				t = ft.In(i)
+			}
+			v, e := to_go(arg, t)
+			if e != nil {
+				return nil, TypeError(fmt.Sprintf("%s: argument %d: %v", name, i+1, e))
+			}
+			args[i] = v
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				err = TypeError(fmt.Sprintf("%s: %v", name, r))
+			}
+		}()
+		out := fv.Call(args)
+		if has_err {
+			if e := out[nout-1]; !e.IsNil() {
+				return nil, e.Interface().(error)
+			}
+			out = out[:nout-1]
+		}
+		switch len(out) {
+		case 0:
+			return nil, nil
+		case 1:
+			if res, err = from_go(out[0]); err != nil {
+				return nil, TypeError(fmt.Sprintf("%s: result: %v", name, err))
+			}
+			return res, nil
+		}
+		lst := make([]MalType, len(out))
+		for i, v := range out {
+			item, e := from_go(v)
+			if e != nil {
+				return nil, TypeError(fmt.Sprintf("%s: result %d: %v", name, i+1, e))
+			}
+			lst[i] = item
+		}
+		return Vector{lst, nil}, nil
+	}, nil}
+}
+
+// Bind a Go function in the current namespace, as WrapFunc wraps it
+func (interp *Interpreter) Register(name string, fn interface{}) error {
+	f, e := WrapFunc(name, fn)
+	if e != nil {
+		return e
+	}
+	interp.Define(name, f)
+	return nil
+}
+
+// Make the methods of a Go value the functions of a namespace, named
+// as mal names are, so (require '[strs :as s]) (s/to-upper "x") calls
+// the ToUpper method of the value registered as strs.
+func (interp *Interpreter) RegisterNamespace(name string, api interface{}) error {
+	v := reflect.ValueOf(api)
+	if !v.IsValid() || v.NumMethod() == 0 {
+		return TypeError(name + ": no methods to register")
+	}
+	ns := interp.namespaces.Intern(name)
+	for i := 0; i < v.NumMethod(); i++ {
+		fn_name := mal_name(v.Type().Method(i).Name)
+		ns.Set(Symbol{fn_name}, wrap_func(name+"/"+fn_name, v.Method(i)))
+	}
+	return nil
+}
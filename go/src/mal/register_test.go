@@ -0,0 +1,93 @@
+package mal
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+import (
+	. "types"
+)
+
+type strs struct{}
+
+func (strs) ToUpper(s string) string { return strings.ToUpper(s) }
+
+func (strs) Join(sep string, parts ...string) string { return strings.Join(parts, sep) }
+
+func TestRegister(t *testing.T) {
+	interp, e := New(Options{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	div := func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return a / b, nil
+	}
+	for name, fn := range map[string]interface{}{
+		"div":   div,
+		"upper": strings.ToUpper,
+		"sum": func(xs ...int) int {
+			n := 0
+			for _, x := range xs {
+				n += x
+			}
+			return n
+		},
+		"big":   func() uint64 { return math.MaxUint64 },
+		"small": func() uint64 { return 7 },
+		"boom":  func() int { panic("boom") },
+	} {
+		if e := interp.Register(name, fn); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := interp.RegisterNamespace("strs", strs{}); e != nil {
+		t.Fatal(e)
+	}
+	ctx := context.Background()
+	for _, c := range []struct {
+		src      string
+		want     MalType
+		category string // of the error, if one is wanted
+		msg      string
+	}{
+		{"(div 7 2)", 3, "", ""},
+		{`(upper "abc")`, "ABC", "", ""},
+		{"(sum)", 0, "", ""},
+		{"(sum 1 2 3)", 6, "", ""},
+		{"(small)", 7, "", ""},
+		{"(strs/join \",\" \"a\" \"b\")", "a,b", "", ""},
+		{`(strs/to-upper "x")`, "X", "", ""},
+		{"(div 1)", nil, "arity", "div: wrong number of arguments (got 1, expected 2)"},
+		{"(div 1 2 3)", nil, "arity", "div: wrong number of arguments (got 3, expected 2)"},
+		{"(strs/join)", nil, "arity", "strs/join: wrong number of arguments (got 0, expected at least 1)"},
+		{`(div 1 "x")`, nil, "type", `div: argument 2: cannot use "x" as int`},
+		{`(sum 1 :a)`, nil, "type", "sum: argument 2: cannot use :a as int"},
+		{"(div 1 0)", nil, "type", "division by zero"},
+		{"(boom)", nil, "type", "boom: boom"},
+		{"(big)", nil, "type", "big: result: 18446744073709551615 is too large for an int"},
+	} {
+		res, e := interp.EvalString(ctx, c.src)
+		if c.category == "" {
+			if e != nil || !Equal_Q(res, c.want) {
+				t.Errorf("%s: got %v, %v, want %v", c.src, res, e, c.want)
+			}
+			continue
+		}
+		if e == nil || ErrorCategory(e) != c.category || e.Error() != c.msg {
+			t.Errorf("%s: got %v, want a %s error %q", c.src, e, c.category, c.msg)
+		}
+	}
+	if _, e := WrapFunc("x", 42); e == nil {
+		t.Error("WrapFunc accepted a value that is not a function")
+	}
+	if e := interp.RegisterNamespace("none", 42); e == nil {
+		t.Error("RegisterNamespace accepted a value with no methods")
+	}
+}
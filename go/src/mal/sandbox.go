@@ -0,0 +1,100 @@
+package mal
+
+import (
+	"sort"
+)
+
+import (
+	. "types"
+)
+
+// Sandboxes. An interpreter made with Options.Capabilities has only
+// the builtins those capability sets allow; the others are not defined
+// at all, so nothing eval, a namespace or a qualified name can reach
+// will find them:
+//
+//	pure      computation, namespaces and eval. Always granted.
+//	io-read   slurp, readline, load-file and requiring files
+//	io-write  prn and println
+//	os        *ARGV* and the environment
+//	time      time-ms, timeout and the clock
+//
+// Host functions from StdHost need the capability of what they do;
+// others passed in Options.Host are allowed as they are.
+var Capabilities = []string{"pure", "io-read", "io-write", "os", "time"}
+
+// The capability sets named, all of them if names is nil
+func capability_set(names []string) (map[string]bool, error) {
+	caps := map[string]bool{"pure": true}
+	if names == nil {
+		names = Capabilities
+	}
+	for _, name := range names {
+		known := false
+		for _, c := range Capabilities {
+			known = known || c == name
+		}
+		if !known {
+			return nil, NotFoundError("unknown capability " + name)
+		}
+		caps[name] = true
+	}
+	return caps, nil
+}
+
+// Whether something needing capability may be defined here. Pure
+// things have no capability.
+func (interp *Interpreter) allowed(capability string) bool {
+	return capability == "" || interp.caps[capability]
+}
+
+// (sandbox :pure :time) makes a new interpreter with those of this
+// one's capabilities, and returns its user namespace to eval in. The
+// host functions this one may call and are allowed there come along.
+func (interp *Interpreter) sandbox(a []MalType) (MalType, error) {
+	names := []string{}
+	for _, arg := range a {
+		kw, ok := arg.(string)
+		if !ok || !Keyword_Q(kw) {
+			return nil, TypeError("sandbox requires capability keywords")
+		}
+		if _, e := capability_set([]string{kw[2:]}); e != nil {
+			return nil, e
+		}
+		if interp.allowed(kw[2:]) {
+			names = append(names, kw[2:])
+		}
+	}
+	interp.host_mu.RLock()
+	host := make(map[string]interface{}, len(interp.host))
+	for name, f := range interp.host {
+		host[name] = f
+	}
+	interp.host_mu.RUnlock()
+	sb, e := New(Options{
+		Host:         host,
+		Capabilities: names,
+		MaxSteps:     interp.max_steps,
+		MaxAlloc:     interp.max_alloc,
+		MaxDepth:     interp.max_depth,
+		Evaluator:    interp.evaluator,
+	})
+	if e != nil {
+		return nil, e
+	}
+	return sb.current_ns(), nil
+}
+
+// (capabilities) lists those of the interpreter, as keywords
+func (interp *Interpreter) capabilities(a []MalType) (MalType, error) {
+	names := []string{}
+	for name := range interp.caps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lst := make([]MalType, len(names))
+	for i, name := range names {
+		lst[i], _ = NewKeyword(name)
+	}
+	return List{lst, nil}, nil
+}
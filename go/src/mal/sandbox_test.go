@@ -0,0 +1,17 @@
+package mal
+
+import (
+	"testing"
+)
+
+func TestNewErrors(t *testing.T) {
+	if _, e := New(Options{Capabilities: []string{"pure", "no-such-set"}}); e == nil {
+		t.Error("New accepted an unknown capability")
+	}
+	if _, e := New(Options{Host: map[string]interface{}{"bad": 42}}); e == nil {
+		t.Error("New accepted a host value that is not a function")
+	}
+	if _, e := New(Options{Capabilities: []string{"pure"}}); e != nil {
+		t.Error(e)
+	}
+}
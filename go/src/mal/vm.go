@@ -0,0 +1,480 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+import (
+	. "env"
+	. "types"
+)
+
+// The bytecode VM, what exec runs with the Bytecode evaluator. It has
+// one operand stack, a stack of frames for the function bodies and
+// other code it is running, and a stack of handlers for the try* and
+// binding forms those are inside. As in the tree
+// walker, recursion is limited by memory, or by Options.MaxDepth, which
+// bounds the number of frames.
+
+type frame struct {
+	code   *chunk
+	pc     int
+	env    EnvType
+	base   int     // the height of the operand stack when it began
+	lam    *lambda // the function whose body it is, for stack traces
+	elided int     // tail calls it replaced
+	// for a frame waiting on a call a builtin left, what to do with
+	// the result
+	then func(MalType) (MalType, error)
+}
+
+const (
+	handleCatch = iota
+	handleFinally
+	handleBinding
+)
+
+type handler struct {
+	kind  int
+	frame int // where in the frame stack it was set up
+	sp    int
+	env   EnvType
+	ctx   context.Context // with the bindings outside it
+	try   *tryOp
+}
+
+type vm struct {
+	interp    *Interpreter
+	ctx       context.Context // of the evaluation it is part of
+	ev        *evaluation
+	stack     []MalType
+	frames    []frame
+	handlers  []handler
+	max_depth int
+	done      bool
+	val       MalType
+}
+
+func (interp *Interpreter) run_vm(ctx context.Context, node MalType, env EnvType) (MalType, error) {
+	m := &vm{interp: interp, ctx: ctx, ev: evaluation_of(ctx), max_depth: interp.max_depth}
+	switch n := node.(type) {
+	case *arities:
+		// a multi-arity MalFunc called through Apply
+		f := env.(*Env)
+		args, _ := f.Slot(0, 0)
+		lam, e := n.pick(len(args.(List).Val))
+		if e != nil {
+			return nil, e
+		}
+		if env, e = lam.bind(ctx, f.Up(1), args.(List).Val); e != nil {
+			return nil, e
+		}
+		if e := m.enter(lam, env, false); e != nil {
+			return nil, e
+		}
+	case *lambda:
+		if e := m.enter(n, env, false); e != nil {
+			return nil, e
+		}
+	default:
+		code, e := compile(node, nil)
+		if e != nil {
+			return nil, e
+		}
+		m.frames = append(m.frames, frame{code: code, env: env})
+	}
+	return m.run()
+}
+
+func (m *vm) push(val MalType) {
+	m.stack = append(m.stack, val)
+}
+
+func (m *vm) pop() MalType {
+	val := m.stack[len(m.stack)-1]
+	m.stack = m.stack[:len(m.stack)-1]
+	return val
+}
+
+// The top n values, which are popped
+func (m *vm) pop_n(n int) []MalType {
+	sp := len(m.stack) - n
+	vals := make([]MalType, n)
+	copy(vals, m.stack[sp:])
+	m.stack = m.stack[:sp]
+	return vals
+}
+
+func (m *vm) run() (MalType, error) {
+	for !m.done {
+		if e := m.exec(); e != nil {
+			if e = m.raise(e); e != nil {
+				return nil, e
+			}
+		}
+	}
+	return m.val, nil
+}
+
+// Run the top frame until it returns or an error is raised
+func (m *vm) exec() error {
+	fr := &m.frames[len(m.frames)-1]
+	c := fr.code
+	for {
+		ins := c.code[fr.pc]
+		fr.pc++
+		switch ins.op() {
+		case opConst:
+			m.push(c.consts[ins.arg()])
+		case opLocal:
+			n := &c.locals[ins.arg()]
+			val, ok := fr.env.(*Env).Slot(n.depth, n.slot)
+			if !ok {
+				// not bound yet (a later let* binding), so behave
+				// as though the slot were not there
+				var e error
+				if val, e = lookup_var(m.ctx, fr.env, n.sym); e != nil {
+					return e
+				}
+			}
+			m.push(val)
+		case opGlobal:
+			val, e := c.cache[ins.arg()].get(m.ctx, &c.globals[ins.arg()], fr.env)
+			if e != nil {
+				return e
+			}
+			m.push(val)
+		case opPop:
+			m.stack = m.stack[:len(m.stack)-1]
+		case opJump:
+			fr.pc = ins.arg()
+		case opJumpIfFalse:
+			if cond := m.pop(); cond == nil || cond == false {
+				fr.pc = ins.arg()
+			}
+		case opVector:
+			m.push(Vector{m.pop_n(ins.arg()), nil})
+		case opHashMap:
+			n := c.nodes[ins.arg()].(hashMapNode)
+			m.push(new_hash_map(n.keys, m.pop_n(len(n.keys))))
+		case opDef:
+			val, e := define(c.nodes[ins.arg()].(*defNode), fr.env, m.pop())
+			if e != nil {
+				return e
+			}
+			m.push(val)
+		case opSet:
+			val, e := set_var(m.ctx, c.nodes[ins.arg()].(*setNode), fr.env, m.pop())
+			if e != nil {
+				return e
+			}
+			m.push(val)
+		case opClosure:
+			m.push(m.interp.closure(c.nodes[ins.arg()], fr.env))
+		case opMacroexpand:
+			val, e := m.interp.expand(m.ctx, c.nodes[ins.arg()].(macroexpandNode), fr.env)
+			if e != nil {
+				return e
+			}
+			m.push(val)
+		case opTheEnv:
+			m.push(fr.env)
+		case opLet:
+			fr.env = NewFrame(fr.env, c.nodes[ins.arg()].(*letNode).names, nil)
+		case opStore:
+			fr.env.(*Env).SetSlot(ins.arg(), m.pop())
+		case opLeave:
+			fr.env = fr.env.(*Env).Outer(0)
+		case opRecur:
+			if e := m.step(); e != nil {
+				return e
+			}
+			op := c.nodes[ins.arg()].(recurOp)
+			t := op.n.target
+			vals := m.stack[len(m.stack)-len(op.n.args):]
+			env := NewFrame(fr.env.(*Env).Outer(op.n.depth), t.scope.names, nil)
+			for i, val := range vals {
+				env.SetSlot(t.slots[i], val)
+			}
+			m.stack = m.stack[:len(m.stack)-len(vals)]
+			fr.env = env
+			if op.pc >= 0 {
+				fr.pc = op.pc
+				continue
+			}
+			// a recur in code compiled apart from its target, from a
+			// macro defined after the target was analyzed
+			code, e := t.compiled()
+			if e != nil {
+				return e
+			}
+			c, fr.code, fr.pc = code, code, 0
+		case opCheckMacro:
+			f, ok := m.stack[len(m.stack)-1].(MalFunc)
+			if !ok || !f.GetMacro() {
+				continue
+			}
+			// a macro defined after this call was analyzed
+			m.pop()
+			op := c.nodes[ins.arg()].(*appOp)
+			node, e := m.interp.reanalyze(m.ctx, op.n, f, fr.env)
+			if e != nil {
+				return e
+			}
+			code, e := compile(node, nil)
+			if e != nil {
+				return e
+			}
+			if op.tail {
+				m.stack = m.stack[:fr.base]
+				c, fr.code, fr.pc = code, code, 0
+				continue
+			}
+			fr.pc = op.after
+			return m.push_frame(frame{code: code, env: fr.env, base: len(m.stack)})
+		case opCall, opTailCall:
+			if e := m.step(); e != nil {
+				return e
+			}
+			sp := len(m.stack) - ins.arg()
+			f, args := m.stack[sp-1], m.stack[sp:]
+			m.stack = m.stack[:sp-1]
+			return m.call(f, args, ins.op() == opTailCall)
+		case opReturn:
+			val := m.pop()
+			m.stack = m.stack[:fr.base]
+			m.frames = m.frames[:len(m.frames)-1]
+			return m.deliver(val)
+		case opBindVars:
+			for _, sym := range c.nodes[ins.arg()].(*bindingNode).syms {
+				v, e := dynamic_var(fr.env, sym)
+				if e != nil {
+					return e
+				}
+				m.push(v)
+			}
+		case opBind:
+			n := len(c.nodes[ins.arg()].(*bindingNode).syms)
+			sp := len(m.stack) - 2*n
+			vals := make(map[*Var]MalType, n)
+			for i, v := range m.stack[sp : sp+n] {
+				vals[v.(*Var)] = m.stack[sp+n+i]
+			}
+			m.stack = m.stack[:sp]
+			m.handlers = append(m.handlers, handler{handleBinding, len(m.frames) - 1, sp, fr.env, m.ctx, nil})
+			m.ctx = Bind(m.ctx, vals)
+		case opUnbind:
+			m.ctx = m.handlers[len(m.handlers)-1].ctx
+			m.handlers = m.handlers[:len(m.handlers)-1]
+		case opTry, opFinally:
+			kind := handleCatch
+			if ins.op() == opFinally {
+				kind = handleFinally
+			}
+			op := c.nodes[ins.arg()].(*tryOp)
+			m.handlers = append(m.handlers, handler{kind, len(m.frames) - 1, len(m.stack), fr.env, m.ctx, op})
+		case opEndTry:
+			m.handlers = m.handlers[:len(m.handlers)-1]
+		case opRaise:
+			return m.pop().(error)
+		}
+	}
+}
+
+// What a global symbol last resolved to, in which namespace and at
+// which of its versions
+type lookup struct {
+	ns      *Namespace
+	version uint64
+	val     MalType
+}
+
+// The value of a global in env, looked up again only if the namespace
+// it was found in last time has changed since
+type globalCache struct {
+	last atomic.Pointer[lookup]
+}
+
+func (c *globalCache) get(ctx context.Context, n *globalRef, env EnvType) (MalType, error) {
+	if f, ok := env.(*Env); ok {
+		env = f.Up(n.depth)
+	}
+	ns, ok := env.(*Namespace)
+	if !ok {
+		return lookup_var(ctx, env, n.sym)
+	}
+	version := ns.Version()
+	if l := c.last.Load(); l != nil && l.ns == ns && l.version == version {
+		return var_value(ctx, l.val), nil
+	}
+	val, e := ns.Get(n.sym)
+	if e != nil {
+		return nil, e
+	}
+	c.last.Store(&lookup{ns, version, val})
+	return var_value(ctx, val), nil
+}
+
+// Count a step against the evaluation's budget
+func (m *vm) step() error {
+	return m.ev.step()
+}
+
+func (m *vm) push_frame(fr frame) error {
+	if m.max_depth > 0 && len(m.frames) >= m.max_depth {
+		return LimitError(fmt.Sprintf("maximum evaluation depth of %d exceeded", m.max_depth))
+	}
+	m.frames = append(m.frames, fr)
+	return nil
+}
+
+// Start running the body of lam in env, in place of the top frame for
+// a tail call
+func (m *vm) enter(lam *lambda, env EnvType, tail bool) error {
+	code, e := lam.target.compiled()
+	if e != nil {
+		return e
+	}
+	if !tail {
+		return m.push_frame(frame{code: code, env: env, base: len(m.stack), lam: lam})
+	}
+	fr := &m.frames[len(m.frames)-1]
+	if fr.lam != nil {
+		fr.elided++
+	}
+	m.stack = m.stack[:fr.base]
+	fr.code, fr.pc, fr.env, fr.lam = code, 0, env, lam
+	return nil
+}
+
+// Apply f to args, leaving the result for the top frame. args may be
+// the operand stack above its top, so it is copied before anything is
+// pushed.
+func (m *vm) call(f MalType, args []MalType, tail bool) error {
+	if mf, ok := f.(*MultiFn); ok {
+		// call the method in its place
+		args = copy_args(args)
+		var e error
+		if f, e = m.interp.method(m.ctx, mf, args); e != nil {
+			return e
+		}
+	}
+	switch fn := f.(type) {
+	case MalFunc:
+		var lam *lambda
+		var env *Env
+		var e error
+		switch exp := fn.Exp.(type) {
+		case *arities:
+			if lam, e = exp.pick(len(args)); e == nil {
+				env, e = lam.bind(m.ctx, fn.Env, args)
+			}
+		case *lambda:
+			lam = exp
+			env, e = lam.bind(m.ctx, fn.Env, args)
+		default:
+			return m.deliver_result(m.interp.apply(m.ctx, fn, copy_args(args)))
+		}
+		if e != nil {
+			return e
+		}
+		return m.enter(lam, env, tail)
+	case Func:
+		return m.deliver_result(fn.StepIn(m.ctx, copy_args(args)))
+	case *MultiFn:
+		return m.deliver_result(m.interp.apply(m.ctx, fn, copy_args(args)))
+	default:
+		return TypeError("attempt to call non-function")
+	}
+}
+
+func copy_args(args []MalType) []MalType {
+	return append(make([]MalType, 0, len(args)), args...)
+}
+
+func (m *vm) deliver_result(val MalType, e error) error {
+	if e != nil {
+		return e
+	}
+	return m.deliver(val)
+}
+
+// Give the top frame the value of what it called, doing what a builtin
+// left to do with it first
+func (m *vm) deliver(val MalType) error {
+	for {
+		if c, ok := val.(*Call); ok {
+			if c.Then != nil {
+				if e := m.push_frame(frame{base: len(m.stack), then: c.Then}); e != nil {
+					return e
+				}
+			}
+			return m.call(c.Fn, c.Args, false)
+		}
+		if len(m.frames) == 0 {
+			m.done, m.val = true, val
+			return nil
+		}
+		top := len(m.frames) - 1
+		then := m.frames[top].then
+		if then == nil {
+			m.push(val)
+			return nil
+		}
+		m.frames = m.frames[:top]
+		var e error
+		if val, e = then(val); e != nil {
+			return e
+		}
+	}
+}
+
+// Unwind the frames to the innermost handler, returning the error if
+// there is none to handle it
+func (m *vm) raise(err error) error {
+	for {
+		h := handler{frame: -1}
+		if len(m.handlers) > 0 {
+			h = m.handlers[len(m.handlers)-1]
+			m.handlers = m.handlers[:len(m.handlers)-1]
+		}
+		for len(m.frames)-1 > h.frame {
+			fr := m.frames[len(m.frames)-1]
+			m.frames = m.frames[:len(m.frames)-1]
+			if fr.lam != nil {
+				err = AddFrame(err, fr.lam.frame_name())
+				if fr.elided > 0 {
+					err = AddFrame(err, fmt.Sprintf("... %d more elided by tail calls", fr.elided))
+				}
+			}
+		}
+		if h.frame < 0 {
+			m.done = true
+			return err
+		}
+		m.stack = m.stack[:h.sp]
+		fr := &m.frames[h.frame]
+		fr.env, m.ctx = h.env, h.ctx
+		switch h.kind {
+		case handleCatch:
+			c, exc, e := m.interp.find_catch(m.ctx, h.try.n, err, h.env)
+			if c == nil {
+				err = e
+				continue
+			}
+			for i, clause := range h.try.n.catches {
+				if clause == c {
+					fr.pc = h.try.catches[i]
+				}
+			}
+			fr.env = NewFrame(h.env, c.names, []MalType{exc, ErrorStack(err)})
+			return nil
+		case handleFinally:
+			m.push(err)
+			fr.pc = h.try.fin_err
+			return nil
+		}
+	}
+}
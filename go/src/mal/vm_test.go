@@ -0,0 +1,80 @@
+package mal
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+import (
+	. "types"
+)
+
+var evaluators = []struct {
+	name string
+	ev   Evaluator
+}{
+	{"tree", TreeWalker},
+	{"bytecode", Bytecode},
+	{"closures", Closures},
+}
+
+func eval_with(t testing.TB, opts Options, src string) (MalType, error) {
+	interp, e := New(opts)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return interp.EvalString(context.Background(), src)
+}
+
+// A call in tail position stays one there when a try* around it has
+// nothing to catch or clean up, so the depth limit is never reached
+func TestTailCallInTry(t *testing.T) {
+	src := `(def! try-loop (fn* [n] (if (= n 0) :done (try* (try-loop (- n 1))))))
+		(try-loop 100000)`
+	for _, ev := range evaluators {
+		res, e := eval_with(t, Options{Evaluator: ev.ev, MaxDepth: 1000}, src)
+		if e != nil || res != "ʞdone" {
+			t.Errorf("%s: got %v, %v", ev.name, res, e)
+		}
+	}
+}
+
+var bench_programs = []struct {
+	name  string
+	setup string
+	run   string
+}{
+	{"fib", "(def! fib (fn* [n] (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2))))))", "(fib 20)"},
+	{"loop", "", "(loop* [i 0 acc 0] (if (= i 20000) acc (recur (+ i 1) (+ acc i))))"},
+	{"macros", `(def! atm (atom (list 0 1 2 3 4 5 6 7 8 9)))
+		(def! step (fn* [] (do
+		  (or false nil false nil false nil false nil false nil (first @atm))
+		  (cond false 1 nil 2 false 3 nil 4 false 5 nil 6 "else" (first @atm))
+		  (swap! atm (fn* [a] (concat (rest a) (list (first a))))))))
+		(def! steps (fn* [n] (if (= n 0) nil (do (step) (steps (- n 1))))))`, "(steps 1000)"},
+}
+
+// go test -bench . mal compares the evaluators on each program
+func BenchmarkEvaluators(b *testing.B) {
+	for _, p := range bench_programs {
+		for _, ev := range evaluators {
+			b.Run(fmt.Sprintf("%s/%s", p.name, ev.name), func(b *testing.B) {
+				interp, e := New(Options{Evaluator: ev.ev})
+				if e != nil {
+					b.Fatal(e)
+				}
+				ctx := context.Background()
+				if _, e := interp.EvalString(ctx, p.setup); e != nil {
+					b.Fatal(e)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, e := interp.EvalString(ctx, p.run); e != nil {
+						b.Fatal(e)
+					}
+				}
+			})
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package printer
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -9,6 +11,12 @@ import (
 	"types"
 )
 
+func init() {
+	types.Print = func(obj types.MalType) string {
+		return Pr_str(obj, true)
+	}
+}
+
 func Pr_list(lst []types.MalType, pr bool,
 	start string, end string, join string) string {
 	str_list := make([]string, 0, len(lst))
@@ -45,17 +53,70 @@ func Pr_str(obj types.MalType, print_readably bool) string {
 		}
 	case types.Symbol:
 		return tobj.Val
+	case float64:
+		// keep a decimal point so floats read back as floats
+		str := strconv.FormatFloat(tobj, 'g', -1, 64)
+		if !strings.ContainsAny(str, ".eIN") {
+			str += ".0"
+		}
+		return str
 	case nil:
 		return "nil"
 	case types.MalFunc:
+		if tobj.Params == nil {
+			// multi-arity, Exp prints the bodies
+			return "(fn* " + Pr_str(tobj.Exp, true) + ")"
+		}
 		return "(fn* " +
 			Pr_str(tobj.Params, true) + " " +
 			Pr_str(tobj.Exp, true) + ")"
 	case func([]types.MalType) (types.MalType, error):
 		return fmt.Sprintf("<function %v>", obj)
+	case *types.Var:
+		return "#'" + tobj.Name
+	case *types.MultiFn:
+		return "#<multifn " + tobj.Name + ">"
+	case types.Record:
+		str_list := make([]string, 0, len(tobj.Val)*2)
+		for _, k := range tobj.Keys() {
+			str_list = append(str_list, Pr_str(k, print_readably))
+			str_list = append(str_list, Pr_str(tobj.Val[k], print_readably))
+		}
+		return "#" + tobj.Type.Name + "{" + strings.Join(str_list, " ") + "}"
+	case *types.RecordType:
+		return tobj.Name
+	case *types.Protocol:
+		return "#<protocol " + tobj.Name + ">"
 	case *types.Atom:
 		return "(atom " +
-			Pr_str(tobj.Val, true) + ")"
+			Pr_str(tobj.Deref(), true) + ")"
+	case *types.Future:
+		name := "future"
+		if tobj.IsPromise {
+			name = "promise"
+		}
+		if !tobj.Realized() {
+			return "(" + name + " :pending)"
+		}
+		val, _, e := tobj.Wait(context.Background(), -1)
+		if e != nil {
+			return "(" + name + " :failed)"
+		}
+		return "(" + name + " " + Pr_str(val, true) + ")"
+	case *types.Chan:
+		if tobj.Closed() {
+			return fmt.Sprintf("(chan %d :closed)", tobj.Cap())
+		}
+		return fmt.Sprintf("(chan %d)", tobj.Cap())
+	case types.Handle:
+		return fmt.Sprintf("#<go %T>", tobj.Val)
+	case types.ExInfo:
+		str := "#error {:message " + Pr_str(tobj.Message, true) +
+			" :data " + Pr_str(tobj.Data, true)
+		if tobj.Cause != nil {
+			str += " :cause " + Pr_str(tobj.Cause, true)
+		}
+		return str + "}"
 	default:
 		return fmt.Sprintf("%v", obj)
 	}
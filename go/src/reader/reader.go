@@ -20,6 +20,8 @@ type Reader interface {
 type TokenReader struct {
 	tokens   []string
 	position int
+	lines    []int            // line of each token, if wanted
+	starts   map[*MalType]int // line each list starts on
 }
 
 func (tr *TokenReader) next() *string {
@@ -38,19 +40,32 @@ func (tr *TokenReader) peek() *string {
 	return &tr.tokens[tr.position]
 }
 
+// Work around lack of quoting in backtick
+var token_re = regexp.MustCompile(`[\s,]*(~@|[\[\]{}()'` + "`" +
+	`~^@]|"(?:\\.|[^\\"])*"|;.*|[^\s\[\]{}('"` + "`" +
+	`,;)]*)`)
+
 func tokenize(str string) []string {
+	results, _ := tokenize_lines(str)
+	return results
+}
+
+// Tokenize, also returning the line each token is on
+func tokenize_lines(str string) ([]string, []int) {
 	results := make([]string, 0, 1)
-	// Work around lack of quoting in backtick
-	re := regexp.MustCompile(`[\s,]*(~@|[\[\]{}()'` + "`" +
-		`~^@]|"(?:\\.|[^\\"])*"|;.*|[^\s\[\]{}('"` + "`" +
-		`,;)]*)`)
-	for _, group := range re.FindAllStringSubmatch(str, -1) {
-		if (group[1] == "") || (group[1][0] == ';') {
+	lines := make([]int, 0, 1)
+	line, pos := 1, 0
+	for _, m := range token_re.FindAllStringSubmatchIndex(str, -1) {
+		token := str[m[2]:m[3]]
+		if (token == "") || (token[0] == ';') {
 			continue
 		}
-		results = append(results, group[1])
+		line += strings.Count(str[pos:m[2]], "\n")
+		pos = m[2]
+		results = append(results, token)
+		lines = append(lines, line)
 	}
-	return results
+	return results, lines
 }
 
 func read_atom(rdr Reader) (MalType, error) {
@@ -65,6 +80,12 @@ func read_atom(rdr Reader) (MalType, error) {
 			return nil, errors.New("number parse error")
 		}
 		return i, nil
+	} else if match, _ := regexp.MatchString(`^-?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?$`, *token); match {
+		f, e := strconv.ParseFloat(*token, 64)
+		if e != nil {
+			return nil, errors.New("number parse error")
+		}
+		return f, nil
 	} else if (*token)[0] == '"' {
 		str := (*token)[1 : len(*token)-1]
 		return strings.Replace(
@@ -89,6 +110,11 @@ func read_atom(rdr Reader) (MalType, error) {
 }
 
 func read_list(rdr Reader, start string, end string) (MalType, error) {
+	line := 0
+	if tr, ok := rdr.(*TokenReader); ok && tr.starts != nil &&
+		tr.position < len(tr.lines) {
+		line = tr.lines[tr.position]
+	}
 	token := rdr.next()
 	if token == nil {
 		return nil, errors.New("read_list underflow")
@@ -113,6 +139,9 @@ func read_list(rdr Reader, start string, end string) (MalType, error) {
 		ast_list = append(ast_list, f)
 	}
 	rdr.next()
+	if line > 0 && len(ast_list) > 0 {
+		rdr.(*TokenReader).starts[&ast_list[0]] = line
+	}
 	return List{ast_list, nil}, nil
 }
 
@@ -218,3 +247,34 @@ func Read_str(str string) (MalType, error) {
 
 	return read_form(&TokenReader{tokens: tokens, position: 0})
 }
+
+// Read every form in str, as for a file
+func Read_all(str string) ([]MalType, error) {
+	rdr := &TokenReader{tokens: tokenize(str), position: 0}
+	forms := []MalType{}
+	for rdr.peek() != nil {
+		form, e := read_form(rdr)
+		if e != nil {
+			return nil, e
+		}
+		forms = append(forms, form)
+	}
+	return forms, nil
+}
+
+// Read every form in str, also returning the line each non-empty list
+// or vector starts on, keyed by the address of its first element
+func Read_all_lines(str string) ([]MalType, map[*MalType]int, error) {
+	tokens, lines := tokenize_lines(str)
+	rdr := &TokenReader{tokens: tokens, lines: lines,
+		starts: map[*MalType]int{}}
+	forms := []MalType{}
+	for rdr.peek() != nil {
+		form, e := read_form(rdr)
+		if e != nil {
+			return nil, nil, e
+		}
+		forms = append(forms, form)
+	}
+	return forms, rdr.starts, nil
+}
@@ -1,10 +1,19 @@
 package types
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
 // Errors/Exceptions
@@ -16,6 +25,167 @@ func (e MalError) Error() string {
 	return fmt.Sprintf("%#v", e.Obj)
 }
 
+// An error raised by the interpreter itself. The category is what a
+// catch* clause matches on: not-found, arity, type, io, limit,
+// cancelled or timeout. Err is the Go error behind it, if any.
+type CategoryError struct {
+	Category string
+	Msg      string
+	Err      error
+}
+
+// The categories catch* can name. An ex-info can give itself any
+// other category, which only a predicate catches.
+var ErrorCategories = map[string]bool{
+	"not-found": true, "arity": true, "type": true, "io": true,
+	"user": true, "limit": true, "cancelled": true, "timeout": true,
+}
+
+func (e CategoryError) Error() string {
+	return e.Msg
+}
+
+func (e CategoryError) Unwrap() error {
+	return e.Err
+}
+
+func NotFoundError(msg string) error {
+	return CategoryError{"not-found", msg, nil}
+}
+
+func ArityError(msg string) error {
+	return CategoryError{"arity", msg, nil}
+}
+
+func TypeError(msg string) error {
+	return CategoryError{"type", msg, nil}
+}
+
+func IOError(msg string) error {
+	return CategoryError{"io", msg, nil}
+}
+
+// An evaluation ran out of a budget
+func LimitError(msg string) error {
+	return CategoryError{"limit", msg, nil}
+}
+
+// The error an evaluation stopped through its context fails with. A
+// context cancelled with a mal error as its cause, as running out of a
+// budget does, fails with that error.
+func Cancelled(ctx context.Context) error {
+	cause := context.Cause(ctx)
+	var ce CategoryError
+	if errors.As(cause, &ce) {
+		return cause
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return CategoryError{"timeout", "evaluation timed out", ctx.Err()}
+	}
+	return CategoryError{"cancelled", "evaluation cancelled", ctx.Err()}
+}
+
+// An error along with the mal call stack it unwound through, innermost
+// frame first
+type StackError struct {
+	Err   error
+	Stack []string
+}
+
+func (e *StackError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StackError) Unwrap() error {
+	return e.Err
+}
+
+// Record that an error passed out of a call frame
+func AddFrame(e error, frame string) error {
+	if se, ok := e.(*StackError); ok {
+		se.Stack = append(se.Stack, frame)
+		return se
+	}
+	return &StackError{e, []string{frame}}
+}
+
+// The stack of an error as a mal list of strings
+func ErrorStack(e error) MalType {
+	se, ok := e.(*StackError)
+	if !ok {
+		return List{[]MalType{}, nil}
+	}
+	lst := make([]MalType, len(se.Stack))
+	for i, f := range se.Stack {
+		lst[i] = f
+	}
+	return List{lst, nil}
+}
+
+func unwrap_stack(e error) error {
+	if se, ok := e.(*StackError); ok {
+		return se.Err
+	}
+	return e
+}
+
+// The category of any error. Thrown values are user errors, unless an
+// ex-info names another category with a :category key in its data.
+// Errors from the host's file functions are io errors and anything else
+// is a type error: a value the interpreter could not make sense of.
+func ErrorCategory(e error) string {
+	switch err := unwrap_stack(e).(type) {
+	case MalError:
+		if ex, ok := err.Obj.(ExInfo); ok {
+			if hm, ok := ex.Data.(HashMap); ok {
+				cat, _ := hm.Val["\u029ecategory"].(string)
+				if Keyword_Q(cat) {
+					return cat[2:]
+				}
+			}
+		}
+		return "user"
+	case CategoryError:
+		return err.Category
+	case *os.PathError:
+		return "io"
+	default:
+		return "type"
+	}
+}
+
+// The value a catch* clause binds for an error: the thrown value, or
+// the message of an error raised by the interpreter. An ex-info takes
+// the stack of the error the first time it is caught.
+func ErrorValue(e error) MalType {
+	err, ok := unwrap_stack(e).(MalError)
+	if !ok {
+		return e.Error()
+	}
+	if ex, ok := err.Obj.(ExInfo); ok && ex.Stack == nil {
+		ex.Stack = ErrorStack(e)
+		return ex
+	}
+	return err.Obj
+}
+
+// Exception values made by ex-info
+type ExInfo struct {
+	Message string
+	Data    MalType
+	Cause   MalType
+	Stack   MalType // set where it is first caught
+}
+
+func (ex ExInfo) GoString() string {
+	return fmt.Sprintf("%q", ex.Message)
+}
+
+func ExInfo_Q(obj MalType) bool {
+	_, ok := obj.(ExInfo)
+	return ok
+}
+
 // General types
 type MalType interface {
 }
@@ -24,6 +194,15 @@ type EnvType interface {
 	Find(key Symbol) EnvType
 	Set(key Symbol, value MalType) MalType
 	Get(key Symbol) (MalType, error)
+	// Names bound directly in this environment, not its outers
+	Keys() []Symbol
+	// Remove a binding made directly in this environment
+	Remove(key Symbol) bool
+}
+
+func Env_Q(obj MalType) bool {
+	_, ok := obj.(EnvType)
+	return ok
 }
 
 // Scalars
@@ -42,8 +221,19 @@ func False_Q(obj MalType) bool {
 }
 
 func Number_Q(obj MalType) bool {
-	_, ok := obj.(int)
-	return ok
+	switch obj.(type) {
+	case int, float64:
+		return true
+	}
+	return false
+}
+
+// The value of an int or float64 as a float64
+func ToFloat(obj MalType) float64 {
+	if i, ok := obj.(int); ok {
+		return float64(i)
+	}
+	return obj.(float64)
 }
 
 // Symbols
@@ -83,6 +273,91 @@ func Func_Q(obj MalType) bool {
 	return ok
 }
 
+// Call a core function, making any calls it leaves to the evaluator
+func (f Func) Call(a []MalType) (MalType, error) {
+	return Resolve(f.Step(a))
+}
+
+// Call a core function for an evaluator running in ctx, giving it the
+// context if it asks for it. It may still return a *Call.
+func (f Func) StepIn(ctx context.Context, a []MalType) (MalType, error) {
+	res, e := f.Step(a)
+	if c, ok := res.(*InContext); ok && e == nil {
+		return c.Fn(ctx)
+	}
+	return res, e
+}
+
+// Call a core function, which may return a *Call for the evaluator to
+// make. Most of them take their arguments apart without checking, so
+// the runtime panics that causes are turned into type and arity errors
+// here.
+func (f Func) Step(a []MalType) (res MalType, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch re := r.(type) {
+			case *runtime.TypeAssertionError:
+				err = TypeError(re.Error())
+			case runtime.Error:
+				if !strings.Contains(re.Error(), "index out of range") {
+					panic(r)
+				}
+				err = ArityError("wrong number of arguments (" + strconv.Itoa(len(a)) + ")")
+			default:
+				panic(r)
+			}
+		}
+	}()
+	return f.Fn(a)
+}
+
+// A call a core function such as map or apply leaves to the evaluator,
+// so that it is made on the evaluator's stack rather than Go's. Then,
+// if not nil, is given the call's result and returns the function's,
+// or another Call; if nil, the call's result is the function's.
+type Call struct {
+	Fn   MalType
+	Args []MalType
+	Then func(MalType) (MalType, error)
+}
+
+// A step a core function leaves to the evaluator because it needs the
+// context of the evaluation calling it: to wait in, or for the calls it
+// makes to count against. Fn's result is the function's, and may be a
+// *Call.
+type InContext struct {
+	Fn func(context.Context) (MalType, error)
+}
+
+// A core function that is given the context of the evaluation calling
+// it, by returning an InContext
+func WithContext(f func(context.Context, []MalType) (MalType, error)) func([]MalType) (MalType, error) {
+	return func(a []MalType) (MalType, error) {
+		return &InContext{func(ctx context.Context) (MalType, error) {
+			return f(ctx, a)
+		}}, nil
+	}
+}
+
+// Make the calls a core function left to the evaluator, for callers
+// from Go, which have no evaluation's context to give it
+func Resolve(res MalType, e error) (MalType, error) {
+	for e == nil {
+		switch c := res.(type) {
+		case *Call:
+			res, e = Apply(c.Fn, c.Args)
+			if e == nil && c.Then != nil {
+				res, e = c.Then(res)
+			}
+		case *InContext:
+			res, e = c.Fn(context.Background())
+		default:
+			return res, e
+		}
+	}
+	return res, e
+}
+
 type MalFunc struct {
 	Eval    func(MalType, EnvType) (MalType, error)
 	Exp     MalType
@@ -118,14 +393,26 @@ func Apply(f_mt MalType, a []MalType) (MalType, error) {
 		}
 		return f.Eval(f.Exp, env)
 	case Func:
-		return f.Fn(a)
+		return f.Call(a)
+	case *MultiFn:
+		return f.Call(a)
 	case func([]MalType) (MalType, error):
 		return f(a)
 	default:
-		return nil, errors.New("Invalid function to Apply")
+		return nil, TypeError("Invalid function to Apply")
 	}
 }
 
+// Go values with no mal equivalent, held opaquely for host interop
+type Handle struct {
+	Val interface{}
+}
+
+func Handle_Q(obj MalType) bool {
+	_, ok := obj.(Handle)
+	return ok
+}
+
 // Lists
 type List struct {
 	Val  []MalType
@@ -159,7 +446,7 @@ func GetSlice(seq MalType) ([]MalType, error) {
 	case Vector:
 		return obj.Val, nil
 	default:
-		return nil, errors.New("GetSlice called on non-sequence")
+		return nil, TypeError("GetSlice called on non-sequence")
 	}
 }
 
@@ -175,13 +462,13 @@ func NewHashMap(seq MalType) (MalType, error) {
 		return nil, e
 	}
 	if len(lst)%2 == 1 {
-		return nil, errors.New("Odd number of arguments to NewHashMap")
+		return nil, ArityError("Odd number of arguments to NewHashMap")
 	}
 	m := map[string]MalType{}
 	for i := 0; i < len(lst); i += 2 {
 		str, ok := lst[i].(string)
 		if !ok {
-			return nil, errors.New("expected hash-map key string")
+			return nil, TypeError("expected hash-map key string")
 		}
 		m[str] = lst[i+1]
 	}
@@ -194,21 +481,794 @@ func HashMap_Q(obj MalType) bool {
 }
 
 // Atoms
+//
+// The value is held behind an unsafe.Pointer to an atom_box so that
+// reads, writes and compare-and-set are single atomic operations and
+// atoms can be shared freely between goroutines.
+type atom_box struct {
+	val MalType
+}
+
 type Atom struct {
-	Val  MalType
+	box  unsafe.Pointer
 	Meta MalType
 }
 
+func NewAtom(val MalType) *Atom {
+	return &Atom{unsafe.Pointer(&atom_box{val}), nil}
+}
+
+func (a *Atom) Deref() MalType {
+	return (*atom_box)(atomic.LoadPointer(&a.box)).val
+}
+
 func (a *Atom) Set(val MalType) MalType {
-	a.Val = val
+	atomic.StorePointer(&a.box, unsafe.Pointer(&atom_box{val}))
 	return a
 }
 
+// Atomically set the value to newval if the current value is equal to
+// oldval. Returns whether the value was changed.
+func (a *Atom) CompareAndSet(oldval MalType, newval MalType) bool {
+	for {
+		cur := atomic.LoadPointer(&a.box)
+		if !Equal_Q((*atom_box)(cur).val, oldval) {
+			return false
+		}
+		if atomic.CompareAndSwapPointer(&a.box, cur,
+			unsafe.Pointer(&atom_box{newval})) {
+			return true
+		}
+	}
+}
+
+// Atomically replace the value with the result of f applied to the
+// current value. f may be called more than once if other goroutines
+// change the atom concurrently, so it should be free of side effects.
+func (a *Atom) Swap(f func(MalType) (MalType, error)) (MalType, error) {
+	for {
+		cur := atomic.LoadPointer(&a.box)
+		res, e := f((*atom_box)(cur).val)
+		if e != nil {
+			return nil, e
+		}
+		if atomic.CompareAndSwapPointer(&a.box, cur,
+			unsafe.Pointer(&atom_box{res})) {
+			return res, nil
+		}
+	}
+}
+
+// Swap for the evaluator: a Call of f on the current value and args,
+// which sets the atom to the result if the value has not changed
+// meanwhile, and otherwise calls f again
+func (a *Atom) SwapCall(f MalType, args []MalType) *Call {
+	cur := atomic.LoadPointer(&a.box)
+	fargs := append([]MalType{(*atom_box)(cur).val}, args...)
+	return &Call{f, fargs, func(res MalType) (MalType, error) {
+		if atomic.CompareAndSwapPointer(&a.box, cur, unsafe.Pointer(&atom_box{res})) {
+			return res, nil
+		}
+		return a.SwapCall(f, args), nil
+	}}
+}
+
 func Atom_Q(obj MalType) bool {
 	_, ok := obj.(*Atom)
 	return ok
 }
 
+// Dynamic vars
+//
+// A Var is a global that binding can give another value for the
+// dynamic extent of a form. Bindings are kept in the context of the
+// evaluation that made them, which the evaluators pass along with
+// every call, so they follow it onto the goroutines it hops to. A
+// future or go block started inside a binding starts without them and
+// sees the root values.
+type Var struct {
+	Name string // qualified, ns/name
+	root atomic.Value
+	Meta MalType
+}
+
+type var_root struct {
+	val MalType
+}
+
+type binding_frame struct {
+	vals map[*Var]MalType
+	prev *binding_frame
+}
+
+type bindings_key struct{}
+
+func NewVar(name string, root MalType) *Var {
+	v := &Var{Name: name}
+	v.SetRoot(root)
+	return v
+}
+
+func (v *Var) SetRoot(val MalType) {
+	v.root.Store(var_root{val})
+}
+
+func bindings(ctx context.Context) *binding_frame {
+	fr, _ := ctx.Value(bindings_key{}).(*binding_frame)
+	return fr
+}
+
+// The value of the innermost binding of v in ctx, or the root value
+func (v *Var) Get(ctx context.Context) MalType {
+	for fr := bindings(ctx); fr != nil; fr = fr.prev {
+		if val, ok := fr.vals[v]; ok {
+			return val
+		}
+	}
+	return v.root.Load().(var_root).val
+}
+
+// Change the innermost binding of v in ctx, for set!
+func (v *Var) Set(ctx context.Context, val MalType) error {
+	for fr := bindings(ctx); fr != nil; fr = fr.prev {
+		if _, ok := fr.vals[v]; ok {
+			fr.vals[v] = val
+			return nil
+		}
+	}
+	return TypeError("cannot set! " + v.Name + " outside a binding of it")
+}
+
+// ctx with vars bound to vals, inside the bindings it has
+func Bind(ctx context.Context, vals map[*Var]MalType) context.Context {
+	return context.WithValue(ctx, bindings_key{}, &binding_frame{vals, bindings(ctx)})
+}
+
+// ctx without the bindings it has, for work that starts afresh
+func Unbound(ctx context.Context) context.Context {
+	if bindings(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, bindings_key{}, (*binding_frame)(nil))
+}
+
+func Var_Q(obj MalType) bool {
+	_, ok := obj.(*Var)
+	return ok
+}
+
+// How values appear in error messages raised here, set by the printer
+var Print = func(obj MalType) string {
+	return fmt.Sprintf("%v", obj)
+}
+
+// Hierarchies. Tags, usually keywords, derive from parent tags, and a
+// value isa? another if they are equal, if the second is an ancestor of
+// the first, or if both are vectors whose items are isa? in turn.
+type Hierarchy struct {
+	mu      sync.RWMutex
+	parents []hierarchy_entry
+}
+
+type hierarchy_entry struct {
+	tag     MalType
+	parents []MalType
+}
+
+func NewHierarchy() *Hierarchy {
+	return &Hierarchy{}
+}
+
+func index_of(vals []MalType, val MalType) int {
+	for i, v := range vals {
+		if Equal_Q(v, val) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *Hierarchy) entry(tag MalType) *hierarchy_entry {
+	for i := range h.parents {
+		if Equal_Q(h.parents[i].tag, tag) {
+			return &h.parents[i]
+		}
+	}
+	return nil
+}
+
+// Make parent a parent of child
+func (h *Hierarchy) Derive(child MalType, parent MalType) error {
+	if Equal_Q(child, parent) {
+		return TypeError("cannot derive a tag from itself")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// checked under the lock, so that two derives at once cannot
+	// each pass the check and make a cycle between them
+	if h.isa(parent, child) {
+		return TypeError("cyclic derivation")
+	}
+	ent := h.entry(child)
+	if ent == nil {
+		h.parents = append(h.parents, hierarchy_entry{child, nil})
+		ent = &h.parents[len(h.parents)-1]
+	}
+	if index_of(ent.parents, parent) < 0 {
+		ent.parents = append(ent.parents, parent)
+	}
+	return nil
+}
+
+// The immediate parents of tag, in the order they were derived
+func (h *Hierarchy) Parents(tag MalType) []MalType {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.parents_of(tag)
+}
+
+// The parents of tag, their parents and so on, nearest first
+func (h *Hierarchy) Ancestors(tag MalType) []MalType {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.ancestors(tag)
+}
+
+func (h *Hierarchy) Isa(child MalType, parent MalType) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.isa(child, parent)
+}
+
+// The unlocked versions, for callers holding h.mu
+func (h *Hierarchy) parents_of(tag MalType) []MalType {
+	if ent := h.entry(tag); ent != nil {
+		return append([]MalType{}, ent.parents...)
+	}
+	return nil
+}
+
+func (h *Hierarchy) ancestors(tag MalType) []MalType {
+	ancestors := []MalType{}
+	for todo := h.parents_of(tag); len(todo) > 0; todo = todo[1:] {
+		if index_of(ancestors, todo[0]) < 0 {
+			ancestors = append(ancestors, todo[0])
+			todo = append(todo, h.parents_of(todo[0])...)
+		}
+	}
+	return ancestors
+}
+
+func (h *Hierarchy) isa(child MalType, parent MalType) bool {
+	if Equal_Q(child, parent) {
+		return true
+	}
+	cv, ok1 := child.(Vector)
+	pv, ok2 := parent.(Vector)
+	if ok1 && ok2 {
+		if len(cv.Val) != len(pv.Val) {
+			return false
+		}
+		for i := range cv.Val {
+			if !h.isa(cv.Val[i], pv.Val[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return index_of(h.ancestors(child), parent) >= 0
+}
+
+// Multimethods. Calling a MultiFn applies its dispatch function to the
+// arguments and calls the method for the value that returns. Without a
+// method for that exact value, the method for a value it isa? is
+// called, one preferred over or isa? the others if there are several,
+// and failing that the method for the default dispatch value.
+type MultiFn struct {
+	Name       string
+	Dispatch   MalType
+	DefaultVal MalType
+	Hierarchy  *Hierarchy
+	mu         sync.RWMutex
+	methods    []method_entry
+	prefers    []hierarchy_entry // values preferred over others
+	Meta       MalType
+}
+
+type method_entry struct {
+	val MalType
+	fn  MalType
+}
+
+func NewMultiFn(name string, dispatch MalType, default_val MalType, h *Hierarchy) *MultiFn {
+	return &MultiFn{Name: name, Dispatch: dispatch, DefaultVal: default_val, Hierarchy: h}
+}
+
+func MultiFn_Q(obj MalType) bool {
+	_, ok := obj.(*MultiFn)
+	return ok
+}
+
+func (mf *MultiFn) AddMethod(val MalType, fn MalType) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	for i := range mf.methods {
+		if Equal_Q(mf.methods[i].val, val) {
+			mf.methods[i].fn = fn
+			return
+		}
+	}
+	mf.methods = append(mf.methods, method_entry{val, fn})
+}
+
+func (mf *MultiFn) RemoveMethod(val MalType) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	for i := range mf.methods {
+		if Equal_Q(mf.methods[i].val, val) {
+			mf.methods = append(mf.methods[:i:i], mf.methods[i+1:]...)
+			return
+		}
+	}
+}
+
+// The dispatch values and methods, in the order they were added
+func (mf *MultiFn) Methods() [][2]MalType {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	methods := make([][2]MalType, len(mf.methods))
+	for i, m := range mf.methods {
+		methods[i] = [2]MalType{m.val, m.fn}
+	}
+	return methods
+}
+
+// The method for exactly val, or nil
+func (mf *MultiFn) GetMethod(val MalType) MalType {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	for _, m := range mf.methods {
+		if Equal_Q(m.val, val) {
+			return m.fn
+		}
+	}
+	return nil
+}
+
+// Prefer the method for x over that for y when both apply
+func (mf *MultiFn) PreferMethod(x MalType, y MalType) error {
+	if mf.prefers_Q(y, x) {
+		return TypeError("multimethod " + mf.Name + " already prefers the other way")
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	for i := range mf.prefers {
+		if Equal_Q(mf.prefers[i].tag, x) {
+			mf.prefers[i].parents = append(mf.prefers[i].parents, y)
+			return nil
+		}
+	}
+	mf.prefers = append(mf.prefers, hierarchy_entry{x, []MalType{y}})
+	return nil
+}
+
+// Whether x is preferred over y, directly or through their parents
+func (mf *MultiFn) prefers_Q(x MalType, y MalType) bool {
+	mf.mu.RLock()
+	for _, p := range mf.prefers {
+		if Equal_Q(p.tag, x) && index_of(p.parents, y) >= 0 {
+			mf.mu.RUnlock()
+			return true
+		}
+	}
+	mf.mu.RUnlock()
+	for _, p := range mf.Hierarchy.Parents(y) {
+		if mf.prefers_Q(x, p) {
+			return true
+		}
+	}
+	for _, p := range mf.Hierarchy.Parents(x) {
+		if mf.prefers_Q(p, y) {
+			return true
+		}
+	}
+	return false
+}
+
+func (mf *MultiFn) dominates(x MalType, y MalType) bool {
+	return mf.prefers_Q(x, y) || mf.Hierarchy.Isa(x, y)
+}
+
+// The method to call for args
+func (mf *MultiFn) Method(args []MalType) (MalType, error) {
+	val, e := Apply(mf.Dispatch, args)
+	if e != nil {
+		return nil, e
+	}
+	return mf.MethodFor(val)
+}
+
+// The method for the dispatch value val, which an evaluator gets by
+// calling Dispatch itself
+func (mf *MultiFn) MethodFor(val MalType) (MalType, error) {
+	if fn := mf.GetMethod(val); fn != nil {
+		return fn, nil
+	}
+	var best *method_entry
+	for _, m := range mf.Methods() {
+		m := method_entry{m[0], m[1]}
+		if !mf.Hierarchy.Isa(val, m.val) {
+			continue
+		}
+		switch {
+		case best == nil || mf.dominates(m.val, best.val):
+			best = &m
+		case !mf.dominates(best.val, m.val):
+			return nil, TypeError(fmt.Sprintf(
+				"multimethod %s has several methods for dispatch value %s: %s and %s, and neither is preferred",
+				mf.Name, Print(val), Print(best.val), Print(m.val)))
+		}
+	}
+	if best != nil {
+		return best.fn, nil
+	}
+	if fn := mf.GetMethod(mf.DefaultVal); fn != nil {
+		return fn, nil
+	}
+	return nil, NotFoundError(fmt.Sprintf("multimethod %s has no method for dispatch value %s",
+		mf.Name, Print(val)))
+}
+
+func (mf *MultiFn) Call(args []MalType) (MalType, error) {
+	fn, e := mf.Method(args)
+	if e != nil {
+		return nil, e
+	}
+	return Apply(fn, args)
+}
+
+// Records. A Record holds a value for each field of its RecordType,
+// which is named like user.Point after the namespace it was defined in,
+// and any other keys assoc gave it.
+type RecordType struct {
+	Name   string
+	Fields []string // as keywords
+}
+
+type Record struct {
+	Type *RecordType
+	Val  map[string]MalType
+	Meta MalType
+}
+
+func Record_Q(obj MalType) bool {
+	_, ok := obj.(Record)
+	return ok
+}
+
+// The record's keys, the fields first in order and then the others
+func (r Record) Keys() []string {
+	keys := append([]string{}, r.Type.Fields...)
+	extra := []string{}
+	for k := range r.Val {
+		if index_of_field(r.Type.Fields, k) < 0 {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	return append(keys, extra...)
+}
+
+func index_of_field(fields []string, key string) int {
+	for i, f := range fields {
+		if f == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// The entries of a hash map or a record
+func MapEntries(obj MalType) (map[string]MalType, bool) {
+	switch m := obj.(type) {
+	case HashMap:
+		return m.Val, true
+	case Record:
+		return m.Val, true
+	}
+	return nil, false
+}
+
+// The name of a value's type, which protocols dispatch on: the record
+// type's name for records, nil and keyword, and otherwise the Go
+// type's, such as int, string and types.List
+func TypeName(obj MalType) string {
+	switch o := obj.(type) {
+	case nil:
+		return "nil"
+	case Record:
+		return o.Type.Name
+	case string:
+		if Keyword_Q(o) {
+			return "keyword"
+		}
+	}
+	return fmt.Sprintf("%T", obj)
+}
+
+// Protocols. Each method of a protocol is a MultiFn dispatching on the
+// TypeName of its first argument, with a method for each type the
+// protocol has been extended to.
+type Protocol struct {
+	Name    string
+	Methods []string
+	Fns     map[string]*MultiFn
+}
+
+func NewProtocol(name string, methods []string, h *Hierarchy) *Protocol {
+	p := &Protocol{name, methods, map[string]*MultiFn{}}
+	for _, m := range methods {
+		mf := NewMultiFn(m, nil, nil, h)
+		method := m
+		mf.Dispatch = Func{func(a []MalType) (MalType, error) {
+			if len(a) == 0 {
+				return nil, ArityError(method + " requires at least 1 argument")
+			}
+			t := TypeName(a[0])
+			if mf.GetMethod(t) == nil {
+				return nil, NotFoundError("no implementation of method " + method +
+					" of protocol " + name + " for type " + t)
+			}
+			return t, nil
+		}, nil}
+		p.Fns[m] = mf
+	}
+	return p
+}
+
+func Protocol_Q(obj MalType) bool {
+	_, ok := obj.(*Protocol)
+	return ok
+}
+
+// Implement method for the type named
+func (p *Protocol) Extend(type_name string, method string, fn MalType) error {
+	mf, ok := p.Fns[method]
+	if !ok {
+		return NotFoundError("protocol " + p.Name + " has no method " + method)
+	}
+	mf.AddMethod(type_name, fn)
+	return nil
+}
+
+// Whether the protocol has been extended to the type named
+func (p *Protocol) Extends(type_name string) bool {
+	for _, mf := range p.Fns {
+		if mf.GetMethod(type_name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Futures and promises
+//
+// A Future is a write-once cell. future-call fills it from a goroutine
+// when the function returns; a promise is filled by deliver.
+type Future struct {
+	done      chan struct{}
+	once      sync.Once
+	val       MalType
+	err       error
+	IsPromise bool
+	Meta      MalType
+}
+
+func NewFuture(is_promise bool) *Future {
+	return &Future{done: make(chan struct{}), IsPromise: is_promise}
+}
+
+// Fill the future with a value or an error. Only the first delivery
+// has any effect; the return value reports whether this was it.
+func (f *Future) Deliver(val MalType, err error) bool {
+	delivered := false
+	f.once.Do(func() {
+		f.val, f.err = val, err
+		close(f.done)
+		delivered = true
+	})
+	return delivered
+}
+
+func (f *Future) Realized() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Block until the future is realized. If timeout is not negative and
+// elapses first, ok is false; if ctx is done first, err says so.
+func (f *Future) Wait(ctx context.Context, timeout time.Duration) (val MalType, ok bool, err error) {
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-f.done:
+		return f.val, true, f.err
+	case <-expired:
+		return nil, false, nil
+	case <-ctx.Done():
+		return nil, false, Cancelled(ctx)
+	}
+}
+
+func Future_Q(obj MalType) bool {
+	_, ok := obj.(*Future)
+	return ok
+}
+
+// Channels
+//
+// A Chan wraps a Go channel of MalType. The underlying channel is never
+// closed; closing a Chan closes its done channel instead, so a put
+// racing with close! returns false rather than panicking. Takes drain
+// any buffered values first and then return nil. nil itself cannot be
+// put on a channel since it is the closed marker.
+type Chan struct {
+	ch   chan MalType
+	done chan struct{}
+	once sync.Once
+	Meta MalType
+}
+
+// Errors raised in a go block travel over the block's result channel
+// wrapped in a chan_error and are re-raised by whoever takes them.
+type chan_error struct {
+	err error
+}
+
+func NewChan(size int) *Chan {
+	return &Chan{ch: make(chan MalType, size), done: make(chan struct{})}
+}
+
+func (c *Chan) Cap() int {
+	return cap(c.ch)
+}
+
+func (c *Chan) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Chan) Close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// Block until val is put on the channel. Returns false if the channel
+// is closed.
+func (c *Chan) Put(ctx context.Context, val MalType) (bool, error) {
+	if c.Closed() {
+		return false, nil
+	}
+	select {
+	case c.ch <- val:
+		return true, nil
+	case <-c.done:
+		return false, nil
+	case <-ctx.Done():
+		return false, Cancelled(ctx)
+	}
+}
+
+// Put an error on the channel, to be raised by the taker.
+func (c *Chan) Fail(err error) bool {
+	ok, _ := c.Put(context.Background(), chan_error{err})
+	return ok
+}
+
+func (c *Chan) drain() MalType {
+	select {
+	case val := <-c.ch:
+		return val
+	default:
+		return nil
+	}
+}
+
+func chan_result(val MalType) (MalType, error) {
+	if ce, ok := val.(chan_error); ok {
+		return nil, ce.err
+	}
+	return val, nil
+}
+
+// Block until a value is available. Returns nil once the channel is
+// closed and drained.
+func (c *Chan) Take(ctx context.Context) (MalType, error) {
+	select {
+	case val := <-c.ch:
+		return chan_result(val)
+	case <-c.done:
+		return chan_result(c.drain())
+	case <-ctx.Done():
+		return nil, Cancelled(ctx)
+	}
+}
+
+func Chan_Q(obj MalType) bool {
+	_, ok := obj.(*Chan)
+	return ok
+}
+
+// One operation for Alts: a take from Chan, or a put of Val if Put is
+// set.
+type ChanOp struct {
+	Chan *Chan
+	Put  bool
+	Val  MalType
+}
+
+// Perform whichever of ops is ready first, using reflect.Select.
+// Returns the index of the completed op and its result: the value
+// taken, or whether the put succeeded. If block is false and nothing
+// is ready, the index is -1, and if ctx is done first the error says
+// so.
+func Alts(ctx context.Context, ops []ChanOp, block bool) (int, MalType, error) {
+	// Each op waits on both its channel and the done channel so
+	// that closing unblocks it; case i belongs to ops[i/2].
+	cases := make([]reflect.SelectCase, 0, 2*len(ops)+1)
+	for _, op := range ops {
+		if op.Put {
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectSend,
+				Chan: reflect.ValueOf(op.Chan.ch),
+				Send: reflect.ValueOf(&op.Val).Elem()})
+		} else {
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(op.Chan.ch)})
+		}
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(op.Chan.done)})
+	}
+	if block {
+		cases = append(cases, reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(ctx.Done())})
+	} else {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	}
+	chosen, recv, _ := reflect.Select(cases)
+	if chosen == 2*len(ops) {
+		if block {
+			return -1, nil, Cancelled(ctx)
+		}
+		return -1, nil, nil
+	}
+	op := ops[chosen/2]
+	switch {
+	case op.Put:
+		return chosen / 2, chosen%2 == 0, nil
+	case chosen%2 == 0:
+		val, e := chan_result(recv.Interface())
+		return chosen / 2, val, e
+	default:
+		val, e := chan_result(op.Chan.drain())
+		return chosen / 2, val, e
+	}
+}
+
 // General functions
 
 func _obj_type(obj MalType) string {
@@ -226,7 +1286,23 @@ func Sequential_Q(seq MalType) bool {
 		(reflect.TypeOf(seq).Name() == "Vector")
 }
 
+func equal_entries(am map[string]MalType, bm map[string]MalType) bool {
+	if len(am) != len(bm) {
+		return false
+	}
+	for k, v := range am {
+		if !Equal_Q(v, bm[k]) {
+			return false
+		}
+	}
+	return true
+}
+
 func Equal_Q(a MalType, b MalType) bool {
+	if Number_Q(a) && Number_Q(b) {
+		// ints and floats are equal if their values are
+		return ToFloat(a) == ToFloat(b)
+	}
 	ota := reflect.TypeOf(a)
 	otb := reflect.TypeOf(b)
 	if !((ota == otb) || (Sequential_Q(a) && Sequential_Q(b))) {
@@ -262,19 +1338,37 @@ func Equal_Q(a MalType, b MalType) bool {
 			}
 		}
 		return true
+	case Record:
+		return a.(Record).Type == b.(Record).Type &&
+			equal_entries(a.(Record).Val, b.(Record).Val)
 	case HashMap:
-		am := a.(HashMap).Val
-		bm := b.(HashMap).Val
-		if len(am) != len(bm) {
+		return equal_entries(a.(HashMap).Val, b.(HashMap).Val)
+	case Handle:
+		av := a.(Handle).Val
+		if av == nil || !reflect.TypeOf(av).Comparable() {
 			return false
 		}
-		for k, v := range am {
-			if !Equal_Q(v, bm[k]) {
-				return false
-			}
-		}
-		return true
+		return av == b.(Handle).Val
+	case ExInfo:
+		ae := a.(ExInfo)
+		be := b.(ExInfo)
+		return ae.Message == be.Message && Equal_Q(ae.Data, be.Data) &&
+			Equal_Q(ae.Cause, be.Cause)
+	case MalFunc:
+		// the same if made by the same fn* in the same environment
+		af := a.(MalFunc)
+		bf := b.(MalFunc)
+		return identical(af.Exp, bf.Exp) && identical(af.Env, bf.Env) &&
+			af.IsMacro == bf.IsMacro
 	default:
+		// Go functions, and what holds them, have no identity to compare
+		return identical(a, b)
+	}
+}
+
+func identical(a MalType, b MalType) bool {
+	if a == nil || b == nil {
 		return a == b
 	}
+	return reflect.TypeOf(a).Comparable() && reflect.TypeOf(b) == reflect.TypeOf(a) && a == b
 }